@@ -0,0 +1,136 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+)
+
+// antialiased reports whether the pixel at (x, y) of img1 is likely part of
+// an antialiased edge, as described in:
+//
+//	Anti-aliased Pixel and Intensity Slope Detector.
+//	V. Vysniauskas.
+//	Elektronika ir Elektrotechnika, 2009.
+//
+// and as implemented by the pixelmatch library:
+//
+//   - https://github.com/mapbox/pixelmatch
+//
+// Neighbors are looked up within the provided radius: larger radii tolerate
+// wider antialiasing (blurred text, ...) but are slower, as each differing
+// pixel scans a (2*radius+1)^2 window.
+func antialiased(img1, img2 *image.RGBA, x, y, radius int) bool {
+	var (
+		bnd    = img1.Bounds()
+		x0     = imax(x-radius, bnd.Min.X)
+		y0     = imax(y-radius, bnd.Min.Y)
+		x1     = imin(x+radius, bnd.Max.X-1)
+		y1     = imin(y+radius, bnd.Max.Y-1)
+		limit  = siblingsLimit(radius)
+		zeroes = 0
+		c      = img1.RGBAAt(x, y)
+
+		min, max               float64
+		minX, minY, maxX, maxY int
+	)
+	if x == x0 || x == x1 || y == y0 || y == y1 {
+		zeroes = 1
+	}
+
+	for xx := x0; xx <= x1; xx++ {
+		for yy := y0; yy <= y1; yy++ {
+			if xx == x && yy == y {
+				continue
+			}
+			// brightness delta between the pixel and its neighbor.
+			delta, _, _ := yiqDelta(c, img1.RGBAAt(xx, yy))
+			switch {
+			case delta == 0:
+				zeroes++
+				// too many equal neighbors: not antialiasing.
+				if zeroes > limit {
+					return false
+				}
+			case delta < min:
+				min = delta
+				minX, minY = xx, yy
+			case delta > max:
+				max = delta
+				maxX, maxY = xx, yy
+			}
+		}
+	}
+
+	// antialiasing requires both darker and brighter neighbors.
+	if min == 0 || max == 0 {
+		return false
+	}
+
+	// the pixel is antialiased if its darkest or brightest neighbor is part
+	// of a flat region in both images.
+	return (hasManySiblings(img1, minX, minY, radius) && hasManySiblings(img2, minX, minY, radius)) ||
+		(hasManySiblings(img1, maxX, maxY, radius) && hasManySiblings(img2, maxX, maxY, radius))
+}
+
+// hasManySiblings reports whether the pixel at (x, y) has many neighbors of
+// the same color, within the provided radius.
+func hasManySiblings(img *image.RGBA, x, y, radius int) bool {
+	bnd := img.Bounds()
+	if !(image.Point{X: x, Y: y}).In(bnd) {
+		return false
+	}
+
+	var (
+		x0     = imax(x-radius, bnd.Min.X)
+		y0     = imax(y-radius, bnd.Min.Y)
+		x1     = imin(x+radius, bnd.Max.X-1)
+		y1     = imin(y+radius, bnd.Max.Y-1)
+		limit  = siblingsLimit(radius)
+		zeroes = 0
+		c      = img.RGBAAt(x, y)
+	)
+	if x == x0 || x == x1 || y == y0 || y == y1 {
+		zeroes = 1
+	}
+
+	for xx := x0; xx <= x1; xx++ {
+		for yy := y0; yy <= y1; yy++ {
+			if xx == x && yy == y {
+				continue
+			}
+			if img.RGBAAt(xx, yy) == c {
+				zeroes++
+			}
+			if zeroes > limit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// siblingsLimit returns the number of equal neighbors above which a pixel
+// is considered part of a flat region, for a given neighborhood radius.
+// It is 2 for the 8 neighbors of a 3x3 window, and scales with the number
+// of neighbors for larger windows.
+func siblingsLimit(radius int) int {
+	n := 2*radius + 1
+	return (n*n - 1) / 4
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// align returns the translation of img2, within [-n, n] pixels along each
+// axis, minimizing its mean difference with img1.
+// Ties are resolved in favor of the smallest translation.
+func align(img1, img2 *image.RGBA, n int, metric func(c1, c2 color.RGBA) float64) image.Point {
+	var (
+		best = image.Point{}
+		dmin = meanDiff(img1, img2, metric)
+	)
+	for dy := -n; dy <= n; dy++ {
+		for dx := -n; dx <= n; dx++ {
+			off := image.Pt(dx, dy)
+			if off == (image.Point{}) {
+				continue
+			}
+			v := meanDiff(img1, translate(img2, off), metric)
+			switch {
+			case v < dmin:
+				best, dmin = off, v
+			case v == dmin && norm1(off) < norm1(best):
+				best = off
+			}
+		}
+	}
+	return best
+}
+
+// translate returns a view of img translated by off.
+// The pixels are shared with img.
+func translate(img *image.RGBA, off image.Point) *image.RGBA {
+	o := *img
+	o.Rect = img.Rect.Add(off)
+	return &o
+}
+
+// meanDiff returns the mean difference between 2 images, over the
+// intersection of their bounds.
+func meanDiff(img1, img2 *image.RGBA, metric func(c1, c2 color.RGBA) float64) float64 {
+	bnd := img1.Bounds().Intersect(img2.Bounds())
+	if bnd.Empty() {
+		return math.Inf(+1)
+	}
+
+	sum := 0.0
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			sum += metric(img1.RGBAAt(x, y), img2.RGBAAt(x, y))
+		}
+	}
+	return sum / float64(bnd.Dx()*bnd.Dy())
+}
+
+func norm1(p image.Point) int {
+	return iabs(p.X) + iabs(p.Y)
+}
+
+func iabs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
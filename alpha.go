@@ -0,0 +1,83 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+)
+
+// Inputs whose color values are stored premultiplied by alpha.
+const (
+	premulNone = "none"
+	premulRef  = "ref"
+	premulCand = "cand"
+	premulBoth = "both"
+)
+
+// validPremultiplied returns an error if name is not a valid value for
+// Options.Premultiplied.
+func validPremultiplied(name string) error {
+	switch name {
+	case premulNone, premulRef, premulCand, premulBoth:
+		return nil
+	default:
+		return fmt.Errorf("unknown premultiplied inputs %q", name)
+	}
+}
+
+// rgbaFrom converts src to RGBA.
+// If premultiplied is true, the color values of src are interpreted as
+// premultiplied by alpha, whatever the color model of src.
+func rgbaFrom(src image.Image, premultiplied bool) *image.RGBA {
+	if premultiplied {
+		return newRGBAFromPremultiplied(src)
+	}
+	if img, ok := src.(*image.RGBA); ok {
+		return img
+	}
+	return newRGBAFrom(src)
+}
+
+// newRGBAFromPremultiplied converts src, whose color values are stored
+// premultiplied by alpha, to RGBA.
+//
+// Image formats such as PNG store straight alpha: files holding
+// premultiplied values are thus decoded as straight alpha images, and a
+// naive conversion would premultiply them a second time.
+func newRGBAFromPremultiplied(src image.Image) *image.RGBA {
+	if img, ok := src.(*image.RGBA); ok {
+		// already premultiplied.
+		return img
+	}
+	defer timed(fmt.Sprintf("newRGBAFromPremultiplied(%T)", src), time.Now())
+
+	var (
+		bnds = src.Bounds()
+		dst  = image.NewRGBA(bnds)
+	)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			// premultiplied color values can not exceed alpha.
+			dst.SetRGBA(x, y, color.RGBA{
+				R: umin8(c.R, c.A),
+				G: umin8(c.G, c.A),
+				B: umin8(c.B, c.A),
+				A: c.A,
+			})
+		}
+	}
+	return dst
+}
+
+func umin8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
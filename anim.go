@@ -0,0 +1,285 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+// animation is a sequence of fully composed frames.
+type animation struct {
+	Frames    []image.Image
+	Durations []time.Duration
+}
+
+// loadAnimation loads the frames of the named animated GIF or WebP file.
+// It returns a nil animation for still images and other formats.
+func loadAnimation(name string) (*animation, error) {
+	var decode func(r io.Reader) (*animation, error)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gif":
+		decode = decodeGIFAnim
+	case ".webp":
+		decode = decodeWebPAnim
+	default:
+		return nil, nil
+	}
+	if isURL(name) {
+		return nil, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open image file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	anim, err := decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode frames of image file %q: %w", name, err)
+	}
+	if len(anim.Frames) < 2 {
+		return nil, nil
+	}
+	return anim, nil
+}
+
+// decodeGIFAnim decodes all the frames of a GIF image, applying their
+// disposal methods.
+func decodeGIFAnim(r io.Reader) (*animation, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		anim   = new(animation)
+		canvas = image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	)
+	for i, frame := range g.Image {
+		var prev *image.RGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		anim.Frames = append(anim.Frames, cloneRGBA(canvas))
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		anim.Durations = append(anim.Durations, time.Duration(delay)*10*time.Millisecond)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+	return anim, nil
+}
+
+// decodeWebPAnim decodes all the frames of a WebP image.
+// Still images are decoded as a single frame.
+func decodeWebPAnim(r io.Reader) (*animation, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 12 || string(raw[0:4]) != "RIFF" || string(raw[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("invalid WebP header")
+	}
+
+	var (
+		anim   = new(animation)
+		canvas *image.RGBA
+	)
+	for data := raw[12:]; len(data) >= 8; {
+		var (
+			id   = string(data[0:4])
+			size = int(binary.LittleEndian.Uint32(data[4:8]))
+		)
+		if size < 0 || 8+size > len(data) {
+			return nil, fmt.Errorf("invalid WebP chunk %q", id)
+		}
+		chunk := data[8 : 8+size]
+		data = data[8+size+size%2:]
+
+		switch id {
+		case "VP8X":
+			const animationBit = 1 << 1
+			if len(chunk) < 10 {
+				return nil, fmt.Errorf("invalid WebP VP8X chunk")
+			}
+			if chunk[0]&animationBit == 0 {
+				break
+			}
+			canvas = image.NewRGBA(image.Rect(0, 0, int(uint24(chunk[4:]))+1, int(uint24(chunk[7:]))+1))
+
+		case "ANMF":
+			if canvas == nil || len(chunk) < 16 {
+				return nil, fmt.Errorf("invalid WebP ANMF chunk")
+			}
+			var (
+				x0      = 2 * int(uint24(chunk[0:]))
+				y0      = 2 * int(uint24(chunk[3:]))
+				w       = int(uint24(chunk[6:])) + 1
+				h       = int(uint24(chunk[9:])) + 1
+				dur     = time.Duration(uint24(chunk[12:])) * time.Millisecond
+				noBlend = chunk[15]&(1<<1) != 0
+				dispose = chunk[15]&1 != 0
+			)
+			frame, err := decodeWebPFrame(chunk[16:], w, h)
+			if err != nil {
+				return nil, fmt.Errorf("could not decode WebP frame %d: %w", len(anim.Frames), err)
+			}
+
+			op := draw.Over
+			if noBlend {
+				op = draw.Src
+			}
+			rect := image.Rect(x0, y0, x0+w, y0+h)
+			draw.Draw(canvas, rect, frame, frame.Bounds().Min, op)
+			anim.Frames = append(anim.Frames, cloneRGBA(canvas))
+			anim.Durations = append(anim.Durations, dur)
+			if dispose {
+				draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	if canvas == nil {
+		img, err := webp.Decode(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		anim.Frames = []image.Image{img}
+		anim.Durations = []time.Duration{0}
+	}
+	if len(anim.Frames) == 0 {
+		return nil, fmt.Errorf("animated WebP image without frames")
+	}
+	return anim, nil
+}
+
+// decodeWebPFrame decodes the frame data of an ANMF chunk, of dimensions
+// w x h, by wrapping its ALPH, VP8 and VP8L chunks into a still WebP image.
+func decodeWebPFrame(data []byte, w, h int) (image.Image, error) {
+	buf := new(bytes.Buffer)
+	if len(data) >= 4 && string(data[:4]) == "ALPH" {
+		const alphaBit = 1 << 4
+		hdr := make([]byte, 10)
+		hdr[0] = alphaBit
+		putUint24(hdr[4:], uint32(w-1))
+		putUint24(hdr[7:], uint32(h-1))
+		buf.WriteString("VP8X")
+		_ = binary.Write(buf, binary.LittleEndian, uint32(len(hdr)))
+		buf.Write(hdr)
+	}
+	buf.Write(data)
+
+	riff := new(bytes.Buffer)
+	riff.WriteString("RIFF")
+	_ = binary.Write(riff, binary.LittleEndian, uint32(4+buf.Len()))
+	riff.WriteString("WEBP")
+	riff.Write(buf.Bytes())
+
+	return webp.Decode(riff)
+}
+
+// uint24 decodes a 24-bit little-endian integer.
+func uint24(p []byte) uint32 {
+	return uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16
+}
+
+// putUint24 encodes v as a 24-bit little-endian integer.
+func putUint24(p []byte, v uint32) {
+	p[0] = byte(v)
+	p[1] = byte(v >> 8)
+	p[2] = byte(v >> 16)
+}
+
+// cloneRGBA returns a copy of img.
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	o := *img
+	o.Pix = append([]uint8(nil), img.Pix...)
+	return &o
+}
+
+// pairDiff compares the named reference and candidate images, decoded as
+// img1 and img2.
+// If any of them is an animation, the frames of both images are compared
+// pairwise, and the result of the frame with the largest difference is
+// returned, along with warnings about mismatched frame counts and durations.
+func pairDiff(ref, cand string, img1, img2 image.Image, opts Options) (Result, error) {
+	a1, err := loadAnimation(ref)
+	if err != nil {
+		return Result{}, err
+	}
+	a2, err := loadAnimation(cand)
+	if err != nil {
+		return Result{}, err
+	}
+	if a1 == nil && a2 == nil {
+		return imageDiffContext(context.Background(), img1, img2, opts)
+	}
+	durs := a1 != nil && a2 != nil
+	if a1 == nil {
+		a1 = &animation{Frames: []image.Image{img1}, Durations: []time.Duration{0}}
+	}
+	if a2 == nil {
+		a2 = &animation{Frames: []image.Image{img2}, Durations: []time.Duration{0}}
+	}
+
+	var (
+		n    = imin(len(a1.Frames), len(a2.Frames))
+		res  Result
+		msgs []string
+	)
+	if len(a1.Frames) != len(a2.Frames) {
+		msgs = append(msgs, fmt.Sprintf(
+			"frame counts differ: %d (reference) vs %d (candidate)",
+			len(a1.Frames), len(a2.Frames),
+		))
+	}
+	for i := 0; i < n; i++ {
+		r, err := imageDiffContext(context.Background(), a1.Frames[i], a2.Frames[i], opts)
+		if err != nil {
+			return Result{}, err
+		}
+		if i == 0 || r.Value() > res.Value() {
+			res = r
+			res.Frame = i
+		}
+		if d1, d2 := a1.Durations[i], a2.Durations[i]; durs && d1 != d2 {
+			msgs = append(msgs, fmt.Sprintf(
+				"durations of frame %d differ: %v (reference) vs %v (candidate)",
+				i, d1, d2,
+			))
+		}
+	}
+	res.Frames = n
+	res.Warnings = append(msgs, res.Warnings...)
+	return res, nil
+}
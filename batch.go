@@ -0,0 +1,623 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// status is the outcome of a comparison in batch mode.
+type status int
+
+const (
+	statusPass status = iota
+	statusWarn
+	statusFail
+)
+
+func (st status) String() string {
+	switch st {
+	case statusFail:
+		return "FAIL"
+	case statusWarn:
+		return "WARN"
+	default:
+		return "PASS"
+	}
+}
+
+// check returns the status of a comparison, given the maximum allowed
+// difference and the warning threshold (disabled if negative).
+func check(res Result, max, warn float64) status {
+	switch v := res.Value(); {
+	case v > max, zonesFailed(res):
+		return statusFail
+	case warn >= 0 && v > warn:
+		return statusWarn
+	default:
+		return statusPass
+	}
+}
+
+// failure describes why the comparison res fails against the max threshold,
+// or the threshold of a zone.
+func failure(res Result, max float64) string {
+	if v := res.Value(); v > max {
+		return fmt.Sprintf("difference %g exceeds threshold %g", v, max)
+	}
+	for i, z := range res.Zones {
+		if z.DMax > z.Max {
+			return fmt.Sprintf("difference %g exceeds threshold %g of zone #%d", z.DMax, z.Max, i+1)
+		}
+	}
+	return fmt.Sprintf("difference %g exceeds threshold %g", res.Value(), max)
+}
+
+// report prints the statistics of a comparison to w.
+func report(w io.Writer, res Result) {
+	if res.Sampled > 0 {
+		fmt.Fprintf(w, "approximate=true (%g of pixels sampled)\n", res.Sampled)
+	}
+	if res.Attempts > 1 {
+		fmt.Fprintf(w, "attempts=%d\n", res.Attempts)
+	}
+	if res.Frames > 0 {
+		fmt.Fprintf(w, "frames=%d, worst=%d\n", res.Frames, res.Frame)
+	}
+	for _, msg := range res.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", msg)
+	}
+	if res.Scaled != scaledNone {
+		fmt.Fprintf(w, "dpr=%g (%s downscaled)\n", res.DPR, res.Scaled)
+	}
+	if res.Equalized {
+		fmt.Fprintf(w, "equalized=true\n")
+	}
+	if res.Blur > 0 {
+		fmt.Fprintf(w, "blur=%g\n", res.Blur)
+	}
+	if res.Aligned || res.Offset != (image.Point{}) {
+		fmt.Fprintf(w, "offset=(%d, %d)\n", res.Offset.X, res.Offset.Y)
+	}
+	if res.Units == unitsJND || res.Units == unitsLevels {
+		fmt.Fprintf(w, "units=%s\n", res.Units)
+	}
+	if res.Range != nil {
+		fmt.Fprintf(w, "range=[%g, %g]\n", res.Range[0], res.Range[1])
+	}
+	fmt.Fprintf(w, "diff=[%g, %g]\n", res.Min, res.Max)
+	fmt.Fprintf(w, "mean=%g, std=%g\n", res.Mean, res.Std)
+	switch {
+	case res.Sampled > 0:
+		fmt.Fprintf(w, "changed=%d (%s of the sampled pixels)\n", res.Changed, formatPercent(1-res.Similarity()))
+	default:
+		fmt.Fprintf(w, "changed=%d\n", res.Changed)
+	}
+	if res.AntiAliased > 0 {
+		fmt.Fprintf(w, "antialiased=%d\n", res.AntiAliased)
+	}
+	if res.Small > 0 {
+		fmt.Fprintf(w, "small=%d\n", res.Small)
+	}
+	if res.Ignored > 0 {
+		fmt.Fprintf(w, "ignored=%d\n", res.Ignored)
+	}
+	if res.Outside > 0 {
+		fmt.Fprintf(w, "outside=%d\n", res.Outside)
+	}
+	if res.Metric != "" {
+		fmt.Fprintf(w, "%s=%g\n", res.Metric, res.Score)
+	}
+	if res.Regions != nil {
+		fmt.Fprintf(w, "regions=%d\n", len(res.Regions))
+		for i, reg := range res.Regions {
+			if i == maxRegions {
+				fmt.Fprintf(w, "region #%d-%d: omitted\n", i+1, len(res.Regions))
+				break
+			}
+			fmt.Fprintf(w,
+				"region #%d: bounds=(%d, %d)-(%d, %d), area=%d, max=%g\n",
+				i+1, reg.Bounds.Min.X, reg.Bounds.Min.Y, reg.Bounds.Max.X, reg.Bounds.Max.Y,
+				reg.Area, reg.Max,
+			)
+		}
+	}
+	if res.Grid != nil {
+		writeGrid(w, res.Grid)
+	}
+	if res.Zones != nil {
+		writeZones(w, res)
+	}
+	if res.Quantization != "" {
+		fmt.Fprintf(w, "note: %s\n", res.Quantization)
+	}
+	if res.Change != "" {
+		fmt.Fprintf(w, "change=%s\n", res.Change)
+	}
+	if res.CVD != "" {
+		fmt.Fprintf(w, "cvd=%s, max=%g, changed=%d\n", res.CVD, res.CVDMax, res.CVDChanged)
+	}
+	if res.Palettes[0] != nil || res.Palettes[1] != nil {
+		fmt.Fprintf(w, "palette1=%s\n", formatPalette(res.Palettes[0]))
+		fmt.Fprintf(w, "palette2=%s\n", formatPalette(res.Palettes[1]))
+		fmt.Fprintf(w, "palette=%g\n", res.PaletteDiff)
+	}
+}
+
+// saveOutputs saves the difference image and its histogram to the files
+// requested in opts, if any.
+func saveOutputs(res Result, opts Options) error {
+	if opts.DiffOut != "" {
+		img := res.Diff
+		if opts.CropToDiff {
+			img = cropDiff(img, res.Changes, opts.CropMargin)
+		}
+		err := saveImage(opts.DiffOut, img, opts)
+		if err != nil {
+			return fmt.Errorf("could not save difference image: %w", err)
+		}
+	}
+
+	if opts.HistOut != "" {
+		bnd := preview(res.Diff).Bounds()
+		img := histDiff(res.Hist, image.Pt(bnd.Dx(), bnd.Dy()), !opts.HistLinear, histThreshold(opts), metricLabel(opts.Metric))
+		if img == nil {
+			return fmt.Errorf("could not render histogram")
+		}
+		err := saveImage(opts.HistOut, img, opts)
+		if err != nil {
+			return fmt.Errorf("could not save histogram: %w", err)
+		}
+	}
+
+	if opts.GridOut != "" {
+		err := saveImage(opts.GridOut, renderGrid(res.Grid, opts.Invert), opts)
+		if err != nil {
+			return fmt.Errorf("could not save grid: %w", err)
+		}
+	}
+
+	if opts.NPYOut != "" {
+		if res.Exact == nil {
+			return fmt.Errorf("no per-pixel differences to save")
+		}
+		err := saveNPY(opts.NPYOut, res.Exact)
+		if err != nil {
+			return fmt.Errorf("could not save per-pixel differences: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Output formats of batch mode.
+const (
+	formatText   = "text"
+	formatGitHub = "github"
+	formatProm   = "prom"
+)
+
+// validFormat returns an error if name is not a supported output format.
+func validFormat(name string) error {
+	switch name {
+	case formatText, formatGitHub, formatProm:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", name)
+	}
+}
+
+// annotate prints to w a GitHub Actions workflow command flagging the
+// comparison of ref and cand as an error or a warning, depending on its
+// status.
+func annotate(w io.Writer, st status, ref, cand string, res Result, max, warn float64) {
+	var cmd, msg string
+	switch st {
+	case statusFail:
+		cmd = "error"
+		msg = failure(res, max)
+	case statusWarn:
+		cmd = "warning"
+		msg = fmt.Sprintf("difference %g exceeds warning threshold %g", res.Value(), warn)
+	default:
+		return
+	}
+	msg = fmt.Sprintf("%s (reference: %s, dmax=%g)", msg, ref, res.Max)
+	workflowCommand(w, cmd, cand, msg)
+}
+
+// annotateError prints to w a GitHub Actions workflow command flagging the
+// comparison of ref and cand as an error, because of err.
+func annotateError(w io.Writer, ref, cand string, err error) {
+	msg := fmt.Sprintf("could not compare images: %v (reference: %s)", err, ref)
+	workflowCommand(w, "error", cand, msg)
+}
+
+// workflowCommand prints to w the GitHub Actions workflow command cmd,
+// with the provided file and message.
+func workflowCommand(w io.Writer, cmd, file, msg string) {
+	prop := strings.NewReplacer(
+		"%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C",
+	)
+	data := strings.NewReplacer(
+		"%", "%25", "\r", "%0D", "\n", "%0A",
+	)
+	fmt.Fprintf(w, "::%s file=%s,title=img-diff::%s\n", cmd, prop.Replace(file), data.Replace(msg))
+}
+
+// progressPeriod is the minimal duration between 2 progress reports.
+const progressPeriod = time.Second
+
+// pair is a pair of images compared in batch mode.
+type pair struct {
+	ref  string  // file name of the reference image
+	cand string  // file name of the candidate image
+	max  float64 // maximum allowed difference
+}
+
+// readManifest reads the pairs of images listed in the manifest file name.
+//
+// Each non-empty line holds the file names of the reference and candidate
+// images, optionally followed by the maximum allowed difference for that
+// pair (max otherwise). Lines starting with '#' are ignored.
+// Relative file names are resolved with respect to the directory of the
+// manifest; URLs and uniform "color:" candidates are kept as is.
+func readManifest(name string, max float64) ([]pair, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open manifest file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	var (
+		dir   = filepath.Dir(name)
+		pairs []pair
+		sc    = bufio.NewScanner(f)
+		line  = 0
+	)
+	resolve := func(fname string) string {
+		if filepath.IsAbs(fname) || isURL(fname) || strings.HasPrefix(fname, "color:") {
+			return fname
+		}
+		return filepath.Join(dir, fname)
+	}
+
+	for sc.Scan() {
+		line++
+		txt := strings.TrimSpace(sc.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+		toks := strings.Fields(txt)
+		switch len(toks) {
+		case 2, 3:
+		default:
+			return nil, fmt.Errorf("invalid manifest line %s:%d: expected 2 or 3 fields, got %d", name, line, len(toks))
+		}
+		p := pair{
+			ref:  resolve(toks[0]),
+			cand: resolve(toks[1]),
+			max:  max,
+		}
+		if len(toks) == 3 {
+			p.max, err = strconv.ParseFloat(toks[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid threshold at manifest line %s:%d: %w", name, line, err)
+			}
+		}
+		pairs = append(pairs, p)
+	}
+
+	err = sc.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan manifest file %q: %w", name, err)
+	}
+
+	return pairs, nil
+}
+
+// dirPairs returns the pairs of images with the same relative file name
+// in the reference directory ref and the candidate directory cand.
+// Only the files whose base name matches the glob pattern are paired, or,
+// if pattern is empty, the files with a supported image extension.
+// Candidates missing from cand are reported when loaded.
+func dirPairs(ref, cand, pattern string, max float64) ([]pair, error) {
+	var pairs []pair
+	err := filepath.Walk(ref, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		switch pattern {
+		case "":
+			if !isImageFile(path) {
+				return nil
+			}
+		default:
+			ok, err := filepath.Match(pattern, filepath.Base(path))
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			if !ok {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(ref, path)
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, pair{
+			ref:  path,
+			cand: filepath.Join(cand, rel),
+			max:  max,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk directory %q: %w", ref, err)
+	}
+	return pairs, nil
+}
+
+// isImageFile reports whether the extension of the named file is the one
+// of a supported image format.
+func isImageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".tif", ".tiff", ".webp", ".raw":
+		return true
+	default:
+		return false
+	}
+}
+
+// loadPair loads the reference and candidate images of p.
+func loadPair(p pair, opts Options) (img1, img2 image.Image, err error) {
+	err = checkMemory(p.ref, p.cand, opts.MaxMemory)
+	if err != nil {
+		return nil, nil, err
+	}
+	img1, err = loadImage(p.ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load image %q: %w", p.ref, err)
+	}
+	img2, err = loadCandidate(p.cand, img1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load image %q: %w", p.cand, err)
+	}
+	return img1, img2, nil
+}
+
+// retryDiff compares the images of p, decoded as img1 and img2, like
+// pairDiff. Failing comparisons are retried up to opts.Retries times,
+// reloading both images, and the result with the smallest difference is
+// returned.
+func retryDiff(p pair, img1, img2 image.Image, opts Options) (Result, error) {
+	res, err := pairDiff(p.ref, p.cand, img1, img2, opts)
+	if err != nil {
+		return res, err
+	}
+	res.Attempts = 1
+	for res.Value() > p.max && res.Attempts <= opts.Retries {
+		debugf("retrying comparison of %q and %q (%d/%d)", p.ref, p.cand, res.Attempts, opts.Retries)
+		img1, img2, err = loadPair(p, opts)
+		if err != nil {
+			return res, err
+		}
+		r, err := pairDiff(p.ref, p.cand, img1, img2, opts)
+		if err != nil {
+			return res, err
+		}
+		r.Attempts = res.Attempts + 1
+		if r.Value() < res.Value() {
+			res = r
+		}
+		res.Attempts = r.Attempts
+	}
+	return res, nil
+}
+
+// anyDiff compares the candidate image cand against each of the baselines
+// refs in turn, like retryDiff, until one of them is within max.
+// It returns the index and result of the first matching baseline, or of
+// the closest one if none matched.
+func anyDiff(cand string, refs []string, max float64, opts Options) (int, Result, error) {
+	var (
+		best = -1
+		res  Result
+	)
+	for i, ref := range refs {
+		p := pair{ref: ref, cand: cand, max: max}
+		img1, img2, err := loadPair(p, opts)
+		if err != nil {
+			return i, res, err
+		}
+		r, err := retryDiff(p, img1, img2, opts)
+		if err != nil {
+			return i, res, fmt.Errorf("could not compare %q and %q: %w", ref, cand, err)
+		}
+		debugf("difference to baseline %q: %g", ref, r.Value())
+		if best < 0 || r.Value() < res.Value() {
+			best, res = i, r
+		}
+		if r.Value() <= max {
+			return i, r, nil
+		}
+	}
+	return best, res, nil
+}
+
+// runPairs compares all the provided pairs of images in batch mode.
+// It returns false if any of the comparisons failed.
+//
+// Pairs whose images can not be loaded or compared are counted as failures,
+// and their errors are logged as they occur.
+// If opts.Progress is set, the progress of the comparisons is periodically
+// printed to stderr.
+// Baselines updated from their candidates, as requested by opts.Update, are
+// not counted as failures.
+// If opts.SummaryOnly is set, only the failing pairs and the overall status
+// are printed.
+func runPairs(pairs []pair, opts Options) bool {
+	var (
+		nfail   = 0
+		nupd    = 0
+		nskip   = 0
+		last    = time.Now()
+		samples []sample
+		failed  []sample
+		nerr    = 0
+		entries []htmlEntry
+		records []jsonRecord
+	)
+	progress := func(i int) {
+		if opts.Progress && i+1 < len(pairs) && time.Since(last) >= progressPeriod {
+			last = time.Now()
+			infof("%d/%d done, %d failing", i+1, len(pairs), nfail)
+		}
+	}
+	// fail records the error err of the comparison of the pair p.
+	fail := func(p pair, err error) {
+		errorf("%s %s: %+v", p.ref, p.cand, err)
+		nfail++
+		nerr++
+		failed = append(failed, sample{ref: p.ref, cand: p.cand, err: err})
+		if opts.Format == formatGitHub {
+			annotateError(os.Stdout, p.ref, p.cand, err)
+		}
+		if opts.HTMLOut != "" {
+			entries = append(entries, newHTMLError(p.ref, p.cand, err))
+		}
+		if opts.JSONOut != "" {
+			records = append(records, newJSONError(p.ref, p.cand, err))
+		}
+	}
+
+	for i, p := range pairs {
+		if opts.FailFast && nfail > 0 {
+			nskip = len(pairs) - i
+			infof("stopping at the first failing pair, skipping %d pairs", nskip)
+			break
+		}
+		img1, img2, err := loadPair(p, opts)
+		if err != nil {
+			fail(p, err)
+			progress(i)
+			continue
+		}
+
+		res, err := retryDiff(p, img1, img2, opts)
+		if err != nil {
+			fail(p, err)
+			progress(i)
+			continue
+		}
+		st := check(res, p.max, opts.Warn)
+		if opts.HTMLOut != "" {
+			e, err := newHTMLEntry(p.ref, p.cand, img1, img2, res, st, opts)
+			if err != nil {
+				fatalf("could not render HTML report of %s %s: %+v", p.ref, p.cand, err)
+			}
+			entries = append(entries, e)
+		}
+		if opts.JSONOut != "" {
+			records = append(records, newJSONRecord(p.ref, p.cand, res, st))
+		}
+		switch opts.Format {
+		case formatProm:
+			samples = append(samples, sample{ref: p.ref, cand: p.cand, res: res})
+		default:
+			if !opts.SummaryOnly {
+				fmt.Printf("%s %s:\n", p.ref, p.cand)
+				report(os.Stdout, res)
+			}
+			if opts.Format == formatGitHub {
+				annotate(os.Stdout, st, p.ref, p.cand, res, p.max, opts.Warn)
+			}
+		}
+		updated := false
+		if needsUpdate(opts.Update, st) {
+			err := updateBaseline(p.ref, p.cand, img2, opts)
+			if err != nil {
+				fatalf("could not update baseline %q: %+v", p.ref, err)
+			}
+			infof("updated baseline %s from %s", p.ref, p.cand)
+			updated = true
+			nupd++
+		}
+		switch st {
+		case statusFail:
+			if !updated {
+				nfail++
+				failed = append(failed, sample{ref: p.ref, cand: p.cand, res: res})
+			}
+			errorf("%s %s: %s", p.ref, p.cand, failure(res, p.max))
+		case statusWarn:
+			warnf("%s %s: difference %g exceeds warning threshold %g", p.ref, p.cand, res.Value(), opts.Warn)
+		}
+		progress(i)
+	}
+
+	if opts.Progress {
+		infof("%d/%d done, %d failing", len(pairs)-nskip, len(pairs), nfail)
+	}
+	summary := fmt.Sprintf("pairs=%d, failed=%d", len(pairs), nfail)
+	if nerr > 0 {
+		summary += fmt.Sprintf(", errors=%d", nerr)
+	}
+	if opts.Update != "" && opts.Update != updateNone {
+		summary += fmt.Sprintf(", updated=%d", nupd)
+	}
+	if nskip > 0 {
+		summary += fmt.Sprintf(", skipped=%d", nskip)
+	}
+	if opts.HTMLOut != "" {
+		err := saveHTMLReport(opts.HTMLOut, entries)
+		if err != nil {
+			fatalf("could not save HTML report: %+v", err)
+		}
+	}
+	if opts.JSONOut != "" {
+		err := appendJSON(opts.JSONOut, records)
+		if err != nil {
+			fatalf("could not save JSON summary: %+v", err)
+		}
+	}
+	if opts.Format == formatProm {
+		writeProm(os.Stdout, samples)
+		infof("%s", summary)
+		return nfail == 0
+	}
+	if opts.SummaryOnly {
+		for _, f := range failed {
+			if f.err != nil {
+				fmt.Printf("FAIL %s %s: %v\n", f.ref, f.cand, f.err)
+				continue
+			}
+			fmt.Printf("FAIL %s %s: dmax=%g", f.ref, f.cand, f.res.Max)
+			if f.res.Metric != "" {
+				fmt.Printf(", %s=%g", f.res.Metric, f.res.Score)
+			}
+			fmt.Printf("\n")
+		}
+		switch nfail {
+		case 0:
+			fmt.Printf("PASS\n")
+		default:
+			fmt.Printf("FAIL\n")
+		}
+	}
+	fmt.Println(summary)
+	return nfail == 0
+}
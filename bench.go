@@ -0,0 +1,53 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// benchDiff compares img1 and img2 warmup times, then repeat times while
+// timing each comparison, and prints the timing statistics to w.
+func benchDiff(w io.Writer, img1, img2 image.Image, warmup, repeat int, opts Options) {
+	for i := 0; i < warmup; i++ {
+		imageDiff(img1, img2, opts)
+	}
+
+	durs := make([]time.Duration, repeat)
+	for i := range durs {
+		start := time.Now()
+		imageDiff(img1, img2, opts)
+		durs[i] = time.Since(start)
+	}
+	if len(durs) == 0 {
+		return
+	}
+
+	sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+	var sum time.Duration
+	for _, d := range durs {
+		sum += d
+	}
+	fmt.Fprintf(w,
+		"bench: runs=%d, warmup=%d, min=%v, mean=%v, p99=%v, max=%v\n",
+		len(durs), warmup,
+		durs[0], sum/time.Duration(len(durs)), durs[rank(len(durs), 0.99)], durs[len(durs)-1],
+	)
+}
+
+// rank returns the index of the p-th percentile, with p in [0, 1], of n
+// sorted values, using the nearest-rank method.
+func rank(n int, p float64) int {
+	i := int(math.Ceil(p*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
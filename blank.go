@@ -0,0 +1,86 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// uniformity tracks whether all the pixels of an image, fed one at a time,
+// have the same color: a blank image is a common rendering failure, better
+// reported as such than as a mere difference.
+type uniformity struct {
+	c    color.RGBA // color of the first pixel
+	n    int        // number of pixels
+	diff bool       // whether a pixel differs from the first one
+}
+
+// imageUniformity returns the uniformity of img.
+func imageUniformity(img *image.RGBA) uniformity {
+	var (
+		u   uniformity
+		bnd = img.Bounds()
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			u.add(img.RGBAAt(x, y))
+			if u.diff {
+				return u
+			}
+		}
+	}
+	return u
+}
+
+// add records the color c of the next pixel.
+func (u *uniformity) add(c color.RGBA) {
+	switch {
+	case u.n == 0:
+		u.c = c
+	case c != u.c:
+		u.diff = true
+	}
+	u.n++
+}
+
+// uniform returns the color of the image if all its pixels have that same
+// color.
+func (u *uniformity) uniform() (color.RGBA, bool) {
+	return u.c, u.n > 0 && !u.diff
+}
+
+// blankWarning returns the warning flagging the reference (i=0) or
+// candidate (i=1) image as uniform, with color c.
+func blankWarning(i int, c color.RGBA) string {
+	return uniformWarning(i, colorName(c))
+}
+
+// uniformWarning returns the warning flagging the reference (i=0) or
+// candidate (i=1) image as uniform, with its single value described by what.
+func uniformWarning(i int, what string) string {
+	name := "reference"
+	if i == 1 {
+		name = "candidate"
+	}
+	return fmt.Sprintf("%s image is uniform (%s)", name, what)
+}
+
+// colorName returns the name of the color c: black, white or transparent,
+// or its non-premultiplied hexadecimal value otherwise.
+func colorName(c color.RGBA) string {
+	switch c {
+	case color.RGBA{A: 0xff}:
+		return "all black"
+	case color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}:
+		return "all white"
+	case color.RGBA{}:
+		return "fully transparent"
+	default:
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		return fmt.Sprintf("single color #%02x%02x%02x%02x", n.R, n.G, n.B, n.A)
+	}
+}
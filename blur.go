@@ -0,0 +1,66 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// gaussianBlur returns a copy of img smoothed by a Gaussian kernel of
+// standard deviation sigma, in pixels.
+// Pixels outside of the image are clamped to its edges.
+func gaussianBlur(img *image.RGBA, sigma float64) *image.RGBA {
+	var (
+		r      = int(math.Ceil(3 * sigma))
+		kernel = make([]float64, 2*r+1)
+		sum    = 0.0
+	)
+	for i := range kernel {
+		x := float64(i - r)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	var (
+		bnd = img.Bounds()
+		tmp = image.NewRGBA(bnd)
+		dst = image.NewRGBA(bnd)
+	)
+	convolve(tmp, img, kernel, 1, 0)
+	convolve(dst, tmp, kernel, 0, 1)
+	return dst
+}
+
+// convolve applies the 1D kernel to src, along the (dx, dy) direction,
+// and stores the result in dst.
+func convolve(dst, src *image.RGBA, kernel []float64, dx, dy int) {
+	var (
+		bnd = src.Bounds()
+		r   = len(kernel) / 2
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			var v [4]float64
+			for k, w := range kernel {
+				var (
+					sx = imin(imax(x+(k-r)*dx, bnd.Min.X), bnd.Max.X-1)
+					sy = imin(imax(y+(k-r)*dy, bnd.Min.Y), bnd.Max.Y-1)
+					i  = src.PixOffset(sx, sy)
+				)
+				for c := range v {
+					v[c] += w * float64(src.Pix[i+c])
+				}
+			}
+			i := dst.PixOffset(x, y)
+			for c := range v {
+				dst.Pix[i+c] = uint8(math.Round(math.Min(v[c], 0xff)))
+			}
+		}
+	}
+}
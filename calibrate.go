@@ -0,0 +1,60 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// calibrationMargin is the relative margin added to the 99th percentile of
+// the differences of a calibration set to recommend a threshold.
+const calibrationMargin = 0.1
+
+// calibrate compares the known-good pairs of images of the calibration
+// directory dir, whose ref and cand subdirectories are paired as in
+// directory mode, and prints to w the distribution of their differences,
+// as checked against -max, and the recommended -max value: their 99th
+// percentile, plus calibrationMargin.
+func calibrate(w io.Writer, dir, pattern string, opts Options) error {
+	pairs, err := dirPairs(filepath.Join(dir, "ref"), filepath.Join(dir, "cand"), pattern, opts.Max)
+	if err != nil {
+		return err
+	}
+
+	var (
+		vals []float64
+		nerr = 0
+	)
+	for _, p := range pairs {
+		img1, img2, err := loadPair(p, opts)
+		if err == nil {
+			var res Result
+			res, err = pairDiff(p.ref, p.cand, img1, img2, opts)
+			if err == nil {
+				debugf("%s %s: %g", p.ref, p.cand, res.Value())
+				vals = append(vals, res.Value())
+				continue
+			}
+		}
+		errorf("%s %s: %+v", p.ref, p.cand, err)
+		nerr++
+	}
+	if len(vals) == 0 {
+		return fmt.Errorf("no pairs of images compared in calibration directory %q", dir)
+	}
+
+	sort.Float64s(vals)
+	quantile := func(p float64) float64 { return vals[rank(len(vals), p)] }
+	fmt.Fprintf(w, "pairs=%d, errors=%d\n", len(vals), nerr)
+	fmt.Fprintf(w,
+		"min=%g, p50=%g, p90=%g, p99=%g, max=%g\n",
+		vals[0], quantile(0.5), quantile(0.9), quantile(0.99), vals[len(vals)-1],
+	)
+	fmt.Fprintf(w, "recommended: -max=%g (p99 + %g%%)\n", quantile(0.99)*(1+calibrationMargin), 100*calibrationMargin)
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strings"
+)
+
+// Maximal absolute differences of the Y, I and Q components of 2 pixels.
+const (
+	yiqMaxY = 255
+	yiqMaxI = (0.59597799 + 0.27417610 + 0.32180189) * 255
+	yiqMaxQ = (0.21147017 + 0.52261711 + 0.31114694) * 255
+)
+
+// runChannels runs the channels sub-command, saving the per-pixel
+// differences of the Y, I and Q components of 2 images.
+func runChannels(args []string) {
+	fset := flag.NewFlagSet("channels", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: img-diff channels [options] ref.png cand.png\n\nOptions:\n")
+		fset.PrintDefaults()
+	}
+
+	out := fset.String("out", "delta", "prefix of the output files (<prefix>-y.png, <prefix>-i.png, <prefix>-q.png)")
+	fset.Parse(args)
+
+	if fset.NArg() != 2 {
+		fset.Usage()
+		fatalf("missing input image(s)")
+	}
+
+	img1, err := loadImage(fset.Arg(0))
+	if err != nil {
+		fatalf("could not load image %q: %+v", fset.Arg(0), err)
+	}
+	img2, err := loadCandidate(fset.Arg(1), img1)
+	if err != nil {
+		fatalf("could not load image %q: %+v", fset.Arg(1), err)
+	}
+
+	chans := yiqChannels(rgbaFrom(img1, false), rgbaFrom(img2, false))
+	for i, name := range []string{"y", "i", "q"} {
+		fname := fmt.Sprintf("%s-%s.png", *out, name)
+		err = saveImage(fname, chans[i].img, Options{})
+		if err != nil {
+			fatalf("could not save %s channel: %+v", name, err)
+		}
+		fmt.Printf("%s: max=%g, mean=%g\n", name, chans[i].max, chans[i].mean)
+	}
+}
+
+// channel holds the absolute per-pixel differences of a YIQ component,
+// normalized to the maximal possible difference of that component.
+type channel struct {
+	img  *image.Gray16
+	max  float64 // maximal difference
+	mean float64 // mean difference
+}
+
+// yiqChannels returns the differences of the Y, I and Q components of
+// img1 and img2, over the intersection of their bounds.
+func yiqChannels(img1, img2 *image.RGBA) [3]channel {
+	var (
+		bnd   = img1.Bounds().Intersect(img2.Bounds())
+		chans [3]channel
+		norms = [3]float64{yiqMaxY, yiqMaxI, yiqMaxQ}
+	)
+	for i := range chans {
+		chans[i].img = image.NewGray16(bnd)
+	}
+	if bnd.Empty() {
+		return chans
+	}
+
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			dy, di, dq := yiqDelta(img1.RGBAAt(x, y), img2.RGBAAt(x, y))
+			for i, v := range [3]float64{dy, di, dq} {
+				v = math.Min(math.Abs(v)/norms[i], 1)
+				chans[i].img.SetGray16(x, y, color.Gray16{Y: uint16(v * math.MaxUint16)})
+				chans[i].max = math.Max(chans[i].max, v)
+				chans[i].mean += v
+			}
+		}
+	}
+
+	n := float64(bnd.Dx() * bnd.Dy())
+	for i := range chans {
+		chans[i].mean /= n
+	}
+	return chans
+}
+
+// channelsAll selects all the RGB channels of the compared images.
+const channelsAll = "rgb"
+
+// validChannels returns an error if s is not a valid value for
+// Options.Channels: a non-empty subset of the letters r, g and b.
+func validChannels(s string) error {
+	if s == "" {
+		return fmt.Errorf("no channel selected")
+	}
+	for i, c := range s {
+		if !strings.ContainsRune(channelsAll, c) {
+			return fmt.Errorf("unknown channel %q", c)
+		}
+		if strings.ContainsRune(s[:i], c) {
+			return fmt.Errorf("duplicate channel %q", c)
+		}
+	}
+	return nil
+}
+
+// maskChannels returns a copy of img whose RGB channels not selected by
+// chans are zeroed, or img itself if all channels are selected.
+func maskChannels(img *image.RGBA, chans string) *image.RGBA {
+	if len(chans) == len(channelsAll) {
+		return img
+	}
+
+	var mask [3]uint8
+	for i, c := range channelsAll {
+		if strings.ContainsRune(chans, c) {
+			mask[i] = 0xff
+		}
+	}
+
+	dst := cloneRGBA(img)
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		dst.Pix[i+0] &= mask[0]
+		dst.Pix[i+1] &= mask[1]
+		dst.Pix[i+2] &= mask[2]
+	}
+	return dst
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// Types of changes between 2 images, as guessed by classifyChange.
+const (
+	changeNone      = "no change"
+	changeShifted   = "shifted"
+	changeRecolored = "recolored"
+	changeAdded     = "added content"
+	changeRemoved   = "removed content"
+)
+
+const (
+	// classifyShift is the maximal translation, in pixels, searched to
+	// detect shifted content.
+	classifyShift = 8
+
+	// classifyShiftGain is the factor by which the best translation must
+	// reduce the mean difference of the changed area for the change to be
+	// classified as a shift.
+	classifyShiftGain = 4
+
+	// classifyBackground is the maximal YIQ difference between a pixel and
+	// the background color of its image for it to be part of the background.
+	classifyBackground = 1e-3
+)
+
+// classifyChange returns a rough guess of the type of change between img1
+// and img2, whose differing pixels lie within chg, using metric.
+//
+// Content moved by a few pixels is classified as shifted. Otherwise, each
+// differing pixel is classified by whether it belongs to the background
+// (the most frequent color) of each image: content appearing over the
+// background is added, content replaced by the background is removed, and
+// content changing color is recolored. The most frequent class wins.
+func classifyChange(img1, img2 *image.RGBA, chg image.Rectangle, metric func(c1, c2 color.RGBA) float64) string {
+	if chg.Empty() {
+		return changeNone
+	}
+
+	if shifted(img1, img2, chg, metric) {
+		return changeShifted
+	}
+
+	var (
+		bg1 = background(img1)
+		bg2 = background(img2)
+
+		nadd, nrem, nrec int
+	)
+	for y := chg.Min.Y; y < chg.Max.Y; y++ {
+		for x := chg.Min.X; x < chg.Max.X; x++ {
+			c1 := img1.RGBAAt(x, y)
+			c2 := img2.RGBAAt(x, y)
+			if c1 == c2 {
+				continue
+			}
+			var (
+				in1 = yiqDiff(c1, bg1) <= classifyBackground
+				in2 = yiqDiff(c2, bg2) <= classifyBackground
+			)
+			switch {
+			case in1 && !in2:
+				nadd++
+			case !in1 && in2:
+				nrem++
+			default:
+				nrec++
+			}
+		}
+	}
+
+	switch {
+	case nadd >= nrem && nadd >= nrec:
+		return changeAdded
+	case nrem >= nrec:
+		return changeRemoved
+	default:
+		return changeRecolored
+	}
+}
+
+// shifted reports whether the differences of img1 and img2 within chg are
+// mostly explained by a small translation of img2.
+func shifted(img1, img2 *image.RGBA, chg image.Rectangle, metric func(c1, c2 color.RGBA) float64) bool {
+	var (
+		area = chg.Inset(-classifyShift)
+		sub1 = img1.SubImage(area.Intersect(img1.Bounds())).(*image.RGBA)
+		sub2 = img2.SubImage(area.Intersect(img2.Bounds())).(*image.RGBA)
+		off  = align(sub1, sub2, classifyShift, metric)
+	)
+	if off == (image.Point{}) {
+		return false
+	}
+
+	// compare over the changed area only, the translated image leaving
+	// its margins uncovered.
+	var (
+		ref   = img1.SubImage(chg).(*image.RGBA)
+		moved = translate(sub2, off)
+		d0    = meanDiff(ref, sub2, metric)
+		d1    = meanDiff(ref, moved, metric)
+	)
+	return d1*classifyShiftGain < d0
+}
+
+// background returns the most frequent color of img.
+func background(img *image.RGBA) color.RGBA {
+	var (
+		bnd  = img.Bounds()
+		hist = make(map[color.RGBA]int)
+		bg   color.RGBA
+		max  = 0
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			n := hist[c] + 1
+			hist[c] = n
+			if n > max {
+				bg, max = c, n
+			}
+		}
+	}
+	return bg
+}
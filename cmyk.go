@@ -0,0 +1,89 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// newRGBAFromCMYK converts a CMYK image to RGBA.
+//
+// The naive conversion provided by color.CMYKToRGB treats inks as ideal
+// filters and yields overly saturated colors, far from what a print
+// workflow would produce.
+// Instead, each ink is modeled as a filter with the reflectance of the
+// corresponding SWOP process color, partial coverages are mixed with the
+// paper white (Murray-Davies) and inks are combined multiplicatively,
+// in linear light.
+func newRGBAFromCMYK(src *image.CMYK) *image.RGBA {
+	var (
+		bnds = src.Bounds()
+		dst  = image.NewRGBA(bnds)
+	)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			dst.SetRGBA(x, y, cmykToRGBA(src.CMYKAt(x, y)))
+		}
+	}
+	return dst
+}
+
+// inks holds the linear reflectances of the SWOP process colors, for the
+// cyan, magenta, yellow and black inks.
+var inks = [4][3]float64{
+	linearRGB(color.RGBA{R: 0x00, G: 0xae, B: 0xef}),
+	linearRGB(color.RGBA{R: 0xec, G: 0x00, B: 0x8c}),
+	linearRGB(color.RGBA{R: 0xff, G: 0xf2, B: 0x00}),
+	linearRGB(color.RGBA{R: 0x23, G: 0x1f, B: 0x20}),
+}
+
+// cmykToRGBA converts a CMYK color to RGBA.
+func cmykToRGBA(v color.CMYK) color.RGBA {
+	var (
+		rgb = [3]float64{1, 1, 1}
+		cov = [4]float64{
+			float64(v.C) / 255,
+			float64(v.M) / 255,
+			float64(v.Y) / 255,
+			float64(v.K) / 255,
+		}
+	)
+	for i, ink := range inks {
+		for j := range rgb {
+			rgb[j] *= 1 - cov[i] + cov[i]*ink[j]
+		}
+	}
+	return color.RGBA{
+		R: srgb8(rgb[0]),
+		G: srgb8(rgb[1]),
+		B: srgb8(rgb[2]),
+		A: 255,
+	}
+}
+
+// linearRGB returns the linear-light components, in [0, 1], of an sRGB color.
+func linearRGB(c color.RGBA) [3]float64 {
+	lin := func(v uint8) float64 {
+		f := float64(v) / 255
+		if f <= 0.04045 {
+			return f / 12.92
+		}
+		return math.Pow((f+0.055)/1.055, 2.4)
+	}
+	return [3]float64{lin(c.R), lin(c.G), lin(c.B)}
+}
+
+// srgb8 encodes a linear-light component, in [0, 1], as an 8-bit sRGB value.
+func srgb8(v float64) uint8 {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(v * 255))
+}
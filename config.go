@@ -0,0 +1,97 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// applyConfig sets the flags of fset from the JSON object stored in the
+// named file, mapping flag names to their values:
+//
+//	{
+//	    "max": 0.05,
+//	    "metric": "yiq",
+//	    "aa": true
+//	}
+//
+// Flags explicitly set on the command line take precedence over the
+// values of the configuration file.
+func applyConfig(fset *flag.FlagSet, name string) error {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	var cfg map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return fmt.Errorf("could not decode config file %q: %w", name, err)
+	}
+
+	set := setFlags(fset)
+
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if k == "config" || fset.Lookup(k) == nil {
+			return fmt.Errorf("invalid flag %q in config file %q", k, name)
+		}
+		if set[k] {
+			continue
+		}
+		var v string
+		switch cv := cfg[k].(type) {
+		case string:
+			v = cv
+		case json.Number, bool:
+			v = fmt.Sprint(cv)
+		default:
+			return fmt.Errorf("invalid value for flag %q in config file %q: %v", k, name, cv)
+		}
+		err = fset.Set(k, v)
+		if err != nil {
+			return fmt.Errorf("invalid value for flag %q in config file %q: %w", k, name, err)
+		}
+	}
+
+	return nil
+}
+
+// useMaxLevels reports whether -max-levels sets the maximum allowed
+// difference, from the flags set on the command line, cli, and the flags
+// set either there or in the config file, set.
+// -max on the command line overrides -max-levels of the config file, and
+// conversely, but both can not be set from the same source.
+func useMaxLevels(cli, set map[string]bool) (bool, error) {
+	switch {
+	case !set["max-levels"]:
+		return false, nil
+	case !set["max"]:
+		return true, nil
+	case cli["max"] == cli["max-levels"]:
+		return false, fmt.Errorf("-max and -max-levels can not be used together")
+	default:
+		return cli["max-levels"], nil
+	}
+}
+
+// setFlags returns the names of the flags of fset which have been set.
+func setFlags(fset *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
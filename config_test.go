@@ -0,0 +1,180 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-diff-")
+	if err != nil {
+		t.Fatalf("could not create tmp dir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name   string
+		cfg    string
+		args   []string
+		max    float64
+		levels float64
+		metric string
+		aa     bool
+		use    bool // whether -max-levels applies
+		err    bool // whether -max and -max-levels conflict
+	}{
+		{
+			name:   "config",
+			cfg:    `{"max": 0.05, "metric": "chebyshev", "aa": true}`,
+			max:    0.05,
+			levels: -1,
+			metric: "chebyshev",
+			aa:     true,
+		},
+		{
+			name:   "cli-overrides-config",
+			cfg:    `{"max": 0.05, "metric": "chebyshev"}`,
+			args:   []string{"-max", "0.2", "-aa"},
+			max:    0.2,
+			levels: -1,
+			metric: "chebyshev",
+			aa:     true,
+		},
+		{
+			name:   "cli-levels-overrides-config-max",
+			cfg:    `{"max": 0.05}`,
+			args:   []string{"-max-levels", "12"},
+			max:    0.05,
+			levels: 12,
+			metric: "yiq",
+			use:    true,
+		},
+		{
+			name:   "cli-max-overrides-config-levels",
+			cfg:    `{"max-levels": 12}`,
+			args:   []string{"-max", "0.2"},
+			max:    0.2,
+			levels: 12,
+			metric: "yiq",
+		},
+		{
+			name:   "config-levels",
+			cfg:    `{"max-levels": 12}`,
+			max:    0.1,
+			levels: 12,
+			metric: "yiq",
+			use:    true,
+		},
+		{
+			name:   "config-max-and-levels",
+			cfg:    `{"max": 0.05, "max-levels": 12}`,
+			max:    0.05,
+			levels: 12,
+			metric: "yiq",
+			err:    true,
+		},
+		{
+			name:   "cli-max-and-levels",
+			cfg:    `{}`,
+			args:   []string{"-max", "0.2", "-max-levels", "12"},
+			max:    0.2,
+			levels: 12,
+			metric: "yiq",
+			err:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				fset   = flag.NewFlagSet("img-diff", flag.ContinueOnError)
+				max    = fset.Float64("max", 0.1, "")
+				levels = fset.Float64("max-levels", -1, "")
+				metric = fset.String("metric", "yiq", "")
+				aa     = fset.Bool("aa", false, "")
+				name   = filepath.Join(dir, tc.name+".json")
+			)
+			fset.String("config", "", "")
+
+			err := ioutil.WriteFile(name, []byte(tc.cfg), 0644)
+			if err != nil {
+				t.Fatalf("could not write config: %+v", err)
+			}
+			err = fset.Parse(tc.args)
+			if err != nil {
+				t.Fatalf("could not parse flags: %+v", err)
+			}
+			cli := setFlags(fset)
+			err = applyConfig(fset, name)
+			if err != nil {
+				t.Fatalf("could not apply config: %+v", err)
+			}
+
+			if *max != tc.max {
+				t.Errorf("invalid -max: got=%g, want=%g", *max, tc.max)
+			}
+			if *levels != tc.levels {
+				t.Errorf("invalid -max-levels: got=%g, want=%g", *levels, tc.levels)
+			}
+			if *metric != tc.metric {
+				t.Errorf("invalid -metric: got=%q, want=%q", *metric, tc.metric)
+			}
+			if *aa != tc.aa {
+				t.Errorf("invalid -aa: got=%v, want=%v", *aa, tc.aa)
+			}
+
+			use, err := useMaxLevels(cli, setFlags(fset))
+			switch {
+			case err != nil && !tc.err:
+				t.Fatalf("unexpected error: %+v", err)
+			case err == nil && tc.err:
+				t.Fatalf("expected an error")
+			}
+			if use != tc.use {
+				t.Errorf("invalid use of -max-levels: got=%v, want=%v", use, tc.use)
+			}
+		})
+	}
+}
+
+func TestApplyConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-diff-")
+	if err != nil {
+		t.Fatalf("could not create tmp dir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name string
+		cfg  string
+	}{
+		{"unknown-flag", `{"no-such-flag": 1}`},
+		{"config", `{"config": "other.json"}`},
+		{"invalid-value", `{"max": "high"}`},
+		{"invalid-type", `{"max": [1, 2]}`},
+		{"invalid-json", `{"max": `},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				fset = flag.NewFlagSet("img-diff", flag.ContinueOnError)
+				name = filepath.Join(dir, tc.name+".json")
+			)
+			fset.Float64("max", 0.1, "")
+			fset.String("config", "", "")
+
+			err := ioutil.WriteFile(name, []byte(tc.cfg), 0644)
+			if err != nil {
+				t.Fatalf("could not write config: %+v", err)
+			}
+			err = applyConfig(fset, name)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
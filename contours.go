@@ -0,0 +1,109 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// contourColors are the colors of the contour lines, from the lowest to
+// the highest level, cycling if there are more levels.
+var contourColors = []color.RGBA{
+	{R: 0x00, G: 0x80, B: 0xff, A: 0xff},
+	{R: 0x00, G: 0xb0, B: 0x40, A: 0xff},
+	{R: 0xff, G: 0x90, B: 0x00, A: 0xff},
+	{R: 0xe0, G: 0x00, B: 0x00, A: 0xff},
+	{R: 0xa0, G: 0x00, B: 0xc0, A: 0xff},
+}
+
+// parseLevels parses a comma-separated list of contour levels, in (0, 1],
+// and returns them in increasing order.
+func parseLevels(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	toks := strings.Split(s, ",")
+	levels := make([]float64, len(toks))
+	for i, tok := range toks {
+		v, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse contour level %q: %w", tok, err)
+		}
+		if !(v > 0 && v <= 1) {
+			return nil, fmt.Errorf("invalid contour level %g (must be in (0, 1])", v)
+		}
+		levels[i] = v
+	}
+	sort.Float64s(levels)
+	return levels, nil
+}
+
+// contourDiff returns a rendering of the iso-difference lines of the
+// per-pixel differences stored in diff, at each of levels, over a faded
+// copy of img.
+// A pixel lies on the line of a level if its difference reaches the level
+// while one of its 4 neighbors does not.
+func contourDiff(diff *image.Gray16, img *image.RGBA, levels []float64) *image.RGBA {
+	var (
+		bnd = diff.Bounds()
+		dst = image.NewRGBA(bnd)
+		sub = img.Bounds()
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+			if image.Pt(x, y).In(sub) {
+				// fade the image halfway to white, so that lines stand out.
+				c = img.RGBAAt(x, y)
+				c.R = 0xff - (0xff-c.R)/2
+				c.G = 0xff - (0xff-c.G)/2
+				c.B = 0xff - (0xff-c.B)/2
+				c.A = 0xff
+			}
+			dst.SetRGBA(x, y, c)
+		}
+	}
+
+	for i, lvl := range levels {
+		var (
+			col = contourColors[i%len(contourColors)]
+			lim = uint16(math.Round(lvl * math.MaxUint16))
+			in  = func(x, y int) bool {
+				return image.Pt(x, y).In(bnd) && diff.Gray16At(x, y).Y >= lim
+			}
+		)
+		for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+			for x := bnd.Min.X; x < bnd.Max.X; x++ {
+				if !in(x, y) {
+					continue
+				}
+				if in(x-1, y) && in(x+1, y) && in(x, y-1) && in(x, y+1) {
+					continue
+				}
+				dst.SetRGBA(x, y, col)
+			}
+		}
+	}
+	return dst
+}
+
+// contourKeys returns the legend of the contour lines at levels.
+func contourKeys(levels []float64) []legendKey {
+	keys := make([]legendKey, len(levels))
+	for i, lvl := range levels {
+		keys[i] = legendKey{
+			C:     contourColors[i%len(contourColors)],
+			Label: strconv.FormatFloat(lvl, 'g', -1, 64),
+		}
+	}
+	return keys
+}
@@ -0,0 +1,25 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+)
+
+// cropDiff returns the part of the difference image img within the bounding
+// box of the differing pixels, bnd, enlarged by margin pixels.
+// img is returned as is if no pixel differs.
+func cropDiff(img image.Image, bnd image.Rectangle, margin int) image.Image {
+	if bnd.Empty() {
+		return img
+	}
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return img
+	}
+	return sub.SubImage(bnd.Inset(-margin).Intersect(img.Bounds()))
+}
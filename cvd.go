@@ -0,0 +1,104 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"time"
+)
+
+// Color vision deficiencies simulated by -cvd.
+const (
+	cvdNone   = "none"
+	cvdProtan = "protan" // protanopia: missing long-wavelength cones
+	cvdDeutan = "deutan" // deuteranopia: missing medium-wavelength cones
+	cvdTritan = "tritan" // tritanopia: missing short-wavelength cones
+)
+
+// cvdMatrices are the linear RGB simulation matrices of each color vision
+// deficiency, at full severity, as described in:
+//
+//	A Physiologically-based Model for Simulation of Color Vision Deficiency.
+//	Gustavo M. Machado, Manuel M. Oliveira, Leandro A. F. Fernandes.
+//	IEEE Transactions on Visualization and Computer Graphics, 2009.
+var cvdMatrices = map[string][3][3]float64{
+	cvdProtan: {
+		{0.152286, 1.052583, -0.204868},
+		{0.114503, 0.786281, 0.099216},
+		{-0.003882, -0.048116, 1.051998},
+	},
+	cvdDeutan: {
+		{0.367322, 0.860646, -0.227968},
+		{0.280085, 0.672501, 0.047413},
+		{-0.011820, 0.042940, 0.968881},
+	},
+	cvdTritan: {
+		{1.255528, -0.076749, -0.178779},
+		{-0.078411, 0.930809, 0.147602},
+		{0.004733, 0.691367, 0.303900},
+	},
+}
+
+// validCVD returns an error if name is not a valid color vision deficiency.
+func validCVD(name string) error {
+	if _, ok := cvdMatrices[name]; ok || name == cvdNone {
+		return nil
+	}
+	return fmt.Errorf("unknown color vision deficiency %q", name)
+}
+
+// simulateCVD returns a copy of img, as seen with the color vision
+// deficiency cvd.
+func simulateCVD(img *image.RGBA, cvd string) *image.RGBA {
+	var (
+		m   = cvdMatrices[cvd]
+		lut [256]float64
+		dst = image.NewRGBA(img.Rect)
+	)
+	for i := range lut {
+		lut[i] = linearRGB(color.RGBA{R: uint8(i)})[0]
+	}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			var (
+				c   = img.RGBAAt(x, y)
+				rgb = [3]float64{lut[c.R], lut[c.G], lut[c.B]}
+				sim [3]uint8
+			)
+			for i, row := range m {
+				sim[i] = srgb8(row[0]*rgb[0] + row[1]*rgb[1] + row[2]*rgb[2])
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: sim[0], G: sim[1], B: sim[2], A: c.A})
+		}
+	}
+	return dst
+}
+
+// cvdDiff compares img1 and img2 over bnd, as seen with the color vision
+// deficiency cvd, using metric.
+// It returns the maximal difference and the number of differing pixels.
+func cvdDiff(img1, img2 *image.RGBA, bnd image.Rectangle, cvd string, metric func(c1, c2 color.RGBA) float64) (float64, int) {
+	defer timed("cvdDiff", time.Now())
+
+	var (
+		sim1 = simulateCVD(img1.SubImage(bnd).(*image.RGBA), cvd)
+		sim2 = simulateCVD(img2.SubImage(bnd).(*image.RGBA), cvd)
+		max  = 0.0
+		nchg = 0
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			v := metric(sim1.RGBAAt(x, y), sim2.RGBAAt(x, y))
+			if v > 0 {
+				nchg++
+			}
+			max = math.Max(max, v)
+		}
+	}
+	return max, nchg
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// quantizer reduces 8-bit values to n bits per channel, and back.
+type quantizer func(v uint8, n uint) uint8
+
+// quantizeScale quantizes v to n bits by scaling, as most image encoders do.
+func quantizeScale(v uint8, n uint) uint8 {
+	max := float64(uint(1)<<n - 1)
+	q := math.Round(float64(v) * max / 0xff)
+	return uint8(math.Round(q * 0xff / max))
+}
+
+// quantizeTrunc quantizes v to n bits by dropping its least significant bits.
+func quantizeTrunc(v uint8, n uint) uint8 {
+	return v >> (8 - n) << (8 - n)
+}
+
+// bitDepth returns the smallest number of bits per channel representing
+// exactly the color values of img, with the quantizer q.
+func bitDepth(img *image.RGBA, q quantizer) uint {
+	var seen [256]bool
+	bnd := img.Bounds()
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			seen[c.R] = true
+			seen[c.G] = true
+			seen[c.B] = true
+		}
+	}
+
+loop:
+	for n := uint(1); n < 8; n++ {
+		for v, ok := range seen {
+			if ok && q(uint8(v), n) != uint8(v) {
+				continue loop
+			}
+		}
+		return n
+	}
+	return 8
+}
+
+// quantizationNote analyzes whether the differences between img1 and img2
+// are consistent with one of them being quantized to a lower bit depth,
+// and returns a note describing its findings, if any.
+func quantizationNote(img1, img2 *image.RGBA) string {
+	var (
+		d1, q1 = minDepth(img1)
+		d2, q2 = minDepth(img2)
+	)
+	if d1 == d2 {
+		return ""
+	}
+
+	hi, lo, q, dlo := img1, img2, q2, d2
+	if d1 < d2 {
+		hi, lo, q, dlo = img2, img1, q1, d1
+	}
+
+	bnd := hi.Bounds().Intersect(lo.Bounds())
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			var (
+				ch = hi.RGBAAt(x, y)
+				cl = lo.RGBAAt(x, y)
+			)
+			for _, v := range [][2]uint8{{ch.R, cl.R}, {ch.G, cl.G}, {ch.B, cl.B}} {
+				if iabs(int(q(v[0], dlo))-int(v[1])) > 1 {
+					return fmt.Sprintf(
+						"bit depths differ (%d-bit vs %d-bit) but differences are not explained by quantization",
+						d1, d2,
+					)
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("differences consistent with %d-bit vs %d-bit quantization", d1, d2)
+}
+
+// minDepth returns the bit depth of img, and the quantizer yielding it.
+func minDepth(img *image.RGBA) (uint, quantizer) {
+	var (
+		ds = bitDepth(img, quantizeScale)
+		dt = bitDepth(img, quantizeTrunc)
+	)
+	if dt < ds {
+		return dt, quantizeTrunc
+	}
+	return ds, quantizeScale
+}
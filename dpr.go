@@ -0,0 +1,61 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Images scaled by applyDPR.
+const (
+	scaledNone = ""
+	scaledRef  = "reference"
+	scaledCand = "candidate"
+)
+
+// applyDPR downscales by the device pixel ratio dpr the larger of img1 and
+// img2, so that their logical pixels line up.
+// applyDPR returns the image that was scaled, if any.
+func applyDPR(img1, img2 *image.RGBA, dpr float64) (*image.RGBA, *image.RGBA, string) {
+	if dpr == 1 {
+		return img1, img2, scaledNone
+	}
+
+	var (
+		a1 = img1.Bounds().Dx() * img1.Bounds().Dy()
+		a2 = img2.Bounds().Dx() * img2.Bounds().Dy()
+	)
+	switch {
+	case a1 > a2:
+		return downscale(img1, dpr), img2, scaledRef
+	case a2 > a1:
+		return img1, downscale(img2, dpr), scaledCand
+	default:
+		return img1, img2, scaledNone
+	}
+}
+
+// downscale returns img downscaled by the provided factor.
+func downscale(img *image.RGBA, factor float64) *image.RGBA {
+	var (
+		bnd = img.Bounds()
+		min = image.Pt(
+			int(math.Round(float64(bnd.Min.X)/factor)),
+			int(math.Round(float64(bnd.Min.Y)/factor)),
+		)
+		dst = image.NewRGBA(image.Rectangle{
+			Min: min,
+			Max: min.Add(image.Pt(
+				int(math.Round(float64(bnd.Dx())/factor)),
+				int(math.Round(float64(bnd.Dy())/factor)),
+			)),
+		})
+	)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bnd, xdraw.Src, nil)
+	return dst
+}
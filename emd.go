@@ -0,0 +1,64 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// emd returns the earth mover's distance between the color histograms of
+// 2 images, normalized to [0, 1]: 0 for images with the same colors in the
+// same proportions, wherever they lie, and 1 for a black and a white image.
+//
+// The distance is approximated as the mean of the distances between the
+// histograms of the red, green and blue channels. In one dimension, the
+// earth mover's distance is the area between the cumulative distributions
+// of both histograms.
+func emd(img1, img2 *image.RGBA) float64 {
+	h1 := colorHist(img1)
+	h2 := colorHist(img2)
+	if h1 == nil || h2 == nil {
+		if h1 == nil && h2 == nil {
+			return 0
+		}
+		return 1
+	}
+
+	sum := 0.0
+	for c := range h1 {
+		var cdf1, cdf2, d float64
+		for i := range h1[c] {
+			cdf1 += h1[c][i]
+			cdf2 += h2[c][i]
+			d += math.Abs(cdf1 - cdf2)
+		}
+		sum += d / 0xff
+	}
+	return math.Min(1, sum/float64(len(h1)))
+}
+
+// colorHist returns the normalized histograms of the red, green and blue
+// channels of img, or nil if img is empty.
+func colorHist(img *image.RGBA) [][256]float64 {
+	bnd := img.Bounds()
+	if bnd.Empty() {
+		return nil
+	}
+
+	var (
+		hist = make([][256]float64, 3)
+		w    = 1 / float64(bnd.Dx()*bnd.Dy())
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			hist[0][c.R] += w
+			hist[1][c.G] += w
+			hist[2][c.B] += w
+		}
+	}
+	return hist
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// equalize returns a copy of img whose luminance histogram is equalized.
+// The chrominance of the pixels is preserved, and fully transparent pixels
+// are ignored.
+func equalize(img *image.RGBA) *image.RGBA {
+	var (
+		bnd  = img.Bounds()
+		dst  = image.NewRGBA(bnd)
+		hist [256]int
+		n    = 0
+	)
+
+	straight := func(c color.RGBA) color.NRGBA {
+		return color.NRGBAModel.Convert(c).(color.NRGBA)
+	}
+
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			s := straight(c)
+			yy, _, _ := color.RGBToYCbCr(s.R, s.G, s.B)
+			hist[yy]++
+			n++
+		}
+	}
+	if n == 0 {
+		copy(dst.Pix, img.Pix)
+		return dst
+	}
+
+	// map luminances through the normalized cumulative distribution,
+	// with the lowest occupied level mapped to 0.
+	var (
+		lut  [256]uint8
+		cdf  = 0
+		cmin = 0
+	)
+	for v, cnt := range hist {
+		if cnt > 0 && cmin == 0 {
+			cmin = cnt
+		}
+		cdf += cnt
+		if n == cmin {
+			lut[v] = uint8(v)
+			continue
+		}
+		lut[v] = uint8(math.Round(math.Max(0, float64(cdf-cmin)) * 0xff / float64(n-cmin)))
+	}
+
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c.A == 0 {
+				dst.SetRGBA(x, y, c)
+				continue
+			}
+			s := straight(c)
+			yy, cb, cr := color.RGBToYCbCr(s.R, s.G, s.B)
+			r, g, b := color.YCbCrToRGB(lut[yy], cb, cr)
+			dst.Set(x, y, color.NRGBA{R: r, G: g, B: b, A: s.A})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"reflect"
+)
+
+// exactMatch reports whether the ref and cand image files are identical,
+// printing the outcome to w.
+// Files with the same bytes are identical. Otherwise, unless bytesOnly is
+// set, both images are decoded and identical if all their pixels have the
+// same colors, at 16 bits per channel.
+func exactMatch(w io.Writer, ref, cand string, bytesOnly bool, opts Options) (bool, error) {
+	off, same, err := compareBytes(ref, cand)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case same:
+		fmt.Fprintf(w, "identical=true (same bytes)\n")
+		return true, nil
+	case bytesOnly:
+		fmt.Fprintf(w, "identical=false, bytes differ at offset %d\n", off)
+		return false, nil
+	}
+
+	img1, img2, err := loadPair(pair{ref: ref, cand: cand}, opts)
+	if err != nil {
+		return false, err
+	}
+	n, first := exactDiff(img1, img2)
+	if n == 0 {
+		fmt.Fprintf(w, "identical=true (same pixels)\n")
+		return true, nil
+	}
+	fmt.Fprintf(w, "identical=false, differing=%d, first=(%d, %d)\n", n, first.X, first.Y)
+	return false, nil
+}
+
+// compareBytes reports whether the named files have the same contents,
+// and returns the offset of their first differing byte otherwise.
+func compareBytes(ref, cand string) (int64, bool, error) {
+	f1, err := os.Open(ref)
+	if err != nil {
+		return 0, false, fmt.Errorf("could not open file %q: %w", ref, err)
+	}
+	defer f1.Close()
+	f2, err := os.Open(cand)
+	if err != nil {
+		return 0, false, fmt.Errorf("could not open file %q: %w", cand, err)
+	}
+	defer f2.Close()
+
+	var (
+		r1  = bufio.NewReader(f1)
+		r2  = bufio.NewReader(f2)
+		off int64
+	)
+	for {
+		b1, err1 := r1.ReadByte()
+		b2, err2 := r2.ReadByte()
+		switch {
+		case err1 == io.EOF && err2 == io.EOF:
+			return off, true, nil
+		case err1 != nil && err1 != io.EOF:
+			return off, false, fmt.Errorf("could not read file %q: %w", ref, err1)
+		case err2 != nil && err2 != io.EOF:
+			return off, false, fmt.Errorf("could not read file %q: %w", cand, err2)
+		case err1 != nil || err2 != nil || b1 != b2:
+			return off, false, nil
+		}
+		off++
+	}
+}
+
+// exactDiff returns the number of pixels of img1 and img2 whose colors
+// differ, at 16 bits per channel, and the first of them, row by row.
+// Pixels outside of the intersection of both images differ.
+func exactDiff(img1, img2 image.Image) (int, image.Point) {
+	var (
+		r1    = img1.Bounds()
+		r2    = img2.Bounds()
+		area  = r1.Union(r2)
+		n     = 0
+		first = image.Pt(-1, -1)
+
+		pix1, stride1, bpp = pixels(img1)
+		pix2, stride2, _   = pixels(img2)
+		// images of the same type and width hold the same colors in the
+		// same bytes: matching rows are skipped without decoding them.
+		raw = pix1 != nil && pix2 != nil &&
+			reflect.TypeOf(img1) == reflect.TypeOf(img2) &&
+			r1.Min.X == r2.Min.X && r1.Max.X == r2.Max.X
+	)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		if raw && y >= r1.Min.Y && y < r1.Max.Y && y >= r2.Min.Y && y < r2.Max.Y {
+			var (
+				i1 = (y - r1.Min.Y) * stride1
+				i2 = (y - r2.Min.Y) * stride2
+				m  = r1.Dx() * bpp
+			)
+			if bytes.Equal(pix1[i1:i1+m], pix2[i2:i2+m]) {
+				continue
+			}
+		}
+		for x := area.Min.X; x < area.Max.X; x++ {
+			p := image.Pt(x, y)
+			same := p.In(r1) && p.In(r2)
+			if same {
+				c1r, c1g, c1b, c1a := img1.At(x, y).RGBA()
+				c2r, c2g, c2b, c2a := img2.At(x, y).RGBA()
+				same = c1r == c2r && c1g == c2g && c1b == c2b && c1a == c2a
+			}
+			if same {
+				continue
+			}
+			if n == 0 {
+				first = p
+			}
+			n++
+		}
+	}
+	return n, first
+}
+
+// pixels returns the pixel data of img, its stride and its number of bytes
+// per pixel, or nil if img does not store its pixels in a byte slice.
+func pixels(img image.Image) ([]byte, int, int) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return img.Pix, img.Stride, 4
+	case *image.NRGBA:
+		return img.Pix, img.Stride, 4
+	case *image.RGBA64:
+		return img.Pix, img.Stride, 8
+	case *image.NRGBA64:
+		return img.Pix, img.Stride, 8
+	case *image.Gray:
+		return img.Pix, img.Stride, 1
+	case *image.Gray16:
+		return img.Pix, img.Stride, 2
+	default:
+		return nil, 0, 0
+	}
+}
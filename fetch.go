@@ -0,0 +1,49 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpClient is the client used to fetch remote images.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// isURL reports whether name is an HTTP(S) URL.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// fetchImage fetches and decodes the image located at url.
+// The image format is detected from the content of the response.
+func fetchImage(url string) (image.Image, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch image %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch image %q: %s", url, resp.Status)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch image %q: %w", url, err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image %q: %w", url, err)
+	}
+
+	return convertICC(url, img, raw), nil
+}
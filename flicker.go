@@ -0,0 +1,88 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// flickerDelay is the delay, in 100ths of a second, between the frames of
+// flicker animations.
+const flickerDelay = 50
+
+// flickerFrames returns the frames of a flicker animation of img1 and
+// img2, the latter being resized to the size of the former.
+//
+// Both frames share the same palette and are not dithered: matching pixels
+// get the same color in both frames, so that only the differences flicker.
+func flickerFrames(img1, img2 image.Image) [2]*image.Paletted {
+	var (
+		bnd    = img1.Bounds()
+		rect   = image.Rect(0, 0, bnd.Dx(), bnd.Dy())
+		frames [2]*image.Paletted
+	)
+	for i, img := range []image.Image{img1, img2} {
+		dst := image.NewPaletted(rect, palette.Plan9)
+		switch src := img.Bounds(); {
+		case src.Size() == rect.Size():
+			draw.Draw(dst, rect, img, src.Min, draw.Src)
+		default:
+			rgba := image.NewRGBA(rect)
+			xdraw.CatmullRom.Scale(rgba, rect, img, src, xdraw.Src, nil)
+			draw.Draw(dst, rect, rgba, image.Point{}, draw.Src)
+		}
+		frames[i] = dst
+	}
+	return frames
+}
+
+// writeFlicker writes to w a looping GIF animation alternating img1 and
+// img2.
+func writeFlicker(w io.Writer, img1, img2 image.Image) error {
+	frames := flickerFrames(img1, img2)
+	err := gif.EncodeAll(w, &gif.GIF{
+		Image: frames[:],
+		Delay: []int{flickerDelay, flickerDelay},
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode GIF animation: %w", err)
+	}
+	return nil
+}
+
+// saveFlicker saves the flicker animation of img1 and img2 to the named
+// file, or to stdout if name is "-".
+func saveFlicker(name string, img1, img2 image.Image) error {
+	if name == "-" {
+		return writeFlicker(os.Stdout, img1, img2)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("could not create animation file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	err = writeFlicker(f, img1, img2)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close animation file %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// floatImage is a single-channel image of floating-point samples, such as
+// a depth map or a height field.
+type floatImage struct {
+	Pix    []float64
+	Stride int
+	Rect   image.Rectangle
+	Lo, Hi float64 // range of the finite samples, mapped to black and white for display
+}
+
+func newFloatImage(r image.Rectangle) *floatImage {
+	return &floatImage{
+		Pix:    make([]float64, r.Dx()*r.Dy()),
+		Stride: r.Dx(),
+		Rect:   r,
+	}
+}
+
+func (img *floatImage) ColorModel() color.Model { return color.Gray16Model }
+func (img *floatImage) Bounds() image.Rectangle { return img.Rect }
+
+func (img *floatImage) At(x, y int) color.Color {
+	v := img.FloatAt(x, y)
+	if math.IsNaN(v) || img.Hi <= img.Lo {
+		return color.Gray16{}
+	}
+	t := math.Max(0, math.Min(1, (v-img.Lo)/(img.Hi-img.Lo)))
+	return color.Gray16{Y: uint16(t * math.MaxUint16)}
+}
+
+// FloatAt returns the sample at (x, y), or NaN outside of the image.
+func (img *floatImage) FloatAt(x, y int) float64 {
+	if !(image.Point{x, y}.In(img.Rect)) {
+		return math.NaN()
+	}
+	return img.Pix[(y-img.Rect.Min.Y)*img.Stride+(x-img.Rect.Min.X)]
+}
+
+// setRange sets the display range of img to the range of its finite samples.
+func (img *floatImage) setRange() {
+	img.Lo = math.Inf(+1)
+	img.Hi = math.Inf(-1)
+	for _, v := range img.Pix {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		img.Lo = math.Min(img.Lo, v)
+		img.Hi = math.Max(img.Hi, v)
+	}
+	if img.Lo > img.Hi {
+		img.Lo, img.Hi = 0, 0
+	}
+}
+
+// isTIFF reports whether the named file is a TIFF image, from its extension.
+func isTIFF(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tif", ".tiff":
+		return true
+	default:
+		return false
+	}
+}
+
+// TIFF tags and values needed to decode floating-point images.
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffStripByteCounts = 279
+	tiffPredictor       = 317
+	tiffTileWidth       = 322
+	tiffSampleFormat    = 339
+
+	tiffCompressionNone       = 1
+	tiffCompressionDeflate    = 8
+	tiffCompressionDeflateOld = 32946
+
+	tiffPredictorNone  = 1
+	tiffPredictorFloat = 3
+
+	tiffSampleFormatFloat = 3
+)
+
+// decodeFloatTIFF decodes a single-channel TIFF image of 32-bit or 64-bit
+// floating-point samples, stored in strips, uncompressed or compressed with
+// Deflate.
+// ok is false if raw does not hold floating-point samples, the image being
+// then left to the tiff package.
+func decodeFloatTIFF(raw []byte) (img *floatImage, ok bool, err error) {
+	ifd, bo, err := readTIFFIFD(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	if ifd.value(tiffSampleFormat, 1) != tiffSampleFormatFloat {
+		return nil, false, nil
+	}
+
+	var (
+		w    = int(ifd.value(tiffImageWidth, 0))
+		h    = int(ifd.value(tiffImageLength, 0))
+		bps  = int(ifd.value(tiffBitsPerSample, 0))
+		spp  = ifd.value(tiffSamplesPerPixel, 1)
+		comp = ifd.value(tiffCompression, tiffCompressionNone)
+		pred = ifd.value(tiffPredictor, tiffPredictorNone)
+	)
+	switch {
+	case w <= 0 || h <= 0:
+		return nil, true, fmt.Errorf("invalid TIFF dimensions %dx%d", w, h)
+	case bps != 32 && bps != 64:
+		return nil, true, fmt.Errorf("unsupported floating-point TIFF with %d bits per sample", bps)
+	case spp != 1:
+		return nil, true, fmt.Errorf("unsupported floating-point TIFF with %d samples per pixel", spp)
+	case ifd[tiffTileWidth] != nil:
+		return nil, true, fmt.Errorf("unsupported tiled floating-point TIFF")
+	case pred != tiffPredictorNone && pred != tiffPredictorFloat:
+		return nil, true, fmt.Errorf("unsupported floating-point TIFF predictor %d", pred)
+	}
+
+	var (
+		offs   = ifd.values(tiffStripOffsets)
+		counts = ifd.values(tiffStripByteCounts)
+		data   []byte
+	)
+	if len(offs) == 0 || len(offs) != len(counts) {
+		return nil, true, fmt.Errorf("invalid TIFF strips")
+	}
+	for i, off := range offs {
+		end := off + counts[i]
+		if end < off || end > uint64(len(raw)) {
+			return nil, true, fmt.Errorf("invalid TIFF strip %d", i)
+		}
+		strip := raw[off:end]
+		switch comp {
+		case tiffCompressionNone:
+		case tiffCompressionDeflate, tiffCompressionDeflateOld:
+			r, err := zlib.NewReader(bytes.NewReader(strip))
+			if err != nil {
+				return nil, true, fmt.Errorf("could not decompress TIFF strip %d: %w", i, err)
+			}
+			strip, err = ioutil.ReadAll(r)
+			if err != nil {
+				return nil, true, fmt.Errorf("could not decompress TIFF strip %d: %w", i, err)
+			}
+		default:
+			return nil, true, fmt.Errorf("unsupported floating-point TIFF compression %d", comp)
+		}
+		data = append(data, strip...)
+	}
+
+	var (
+		size = bps / 8
+		row  = w * size
+	)
+	if len(data) < h*row {
+		return nil, true, fmt.Errorf("truncated TIFF image data")
+	}
+
+	img = newFloatImage(image.Rect(0, 0, w, h))
+	buf := make([]byte, row)
+	for y := 0; y < h; y++ {
+		var (
+			src   = data[y*row : (y+1)*row]
+			order = bo
+		)
+		if pred == tiffPredictorFloat {
+			// undo the horizontal differencing, then gather the bytes of
+			// each sample, stored most significant byte first, one byte
+			// plane after the other.
+			for i := 1; i < len(src); i++ {
+				src[i] += src[i-1]
+			}
+			for x := 0; x < w; x++ {
+				for k := 0; k < size; k++ {
+					buf[x*size+k] = src[k*w+x]
+				}
+			}
+			src = buf
+			order = binary.BigEndian
+		}
+		for x := 0; x < w; x++ {
+			p := src[x*size:]
+			v := 0.0
+			switch size {
+			case 4:
+				v = float64(math.Float32frombits(order.Uint32(p)))
+			default:
+				v = math.Float64frombits(order.Uint64(p))
+			}
+			img.Pix[y*img.Stride+x] = v
+		}
+	}
+	img.setRange()
+	return img, true, nil
+}
+
+// floatTIFFDims returns the dimensions of a floating-point TIFF image.
+// ok is false if raw does not hold floating-point samples.
+func floatTIFFDims(raw []byte) (dims image.Point, ok bool, err error) {
+	ifd, _, err := readTIFFIFD(raw)
+	if err != nil {
+		return dims, false, err
+	}
+	if ifd.value(tiffSampleFormat, 1) != tiffSampleFormatFloat {
+		return dims, false, nil
+	}
+	return image.Pt(int(ifd.value(tiffImageWidth, 0)), int(ifd.value(tiffImageLength, 0))), true, nil
+}
+
+// tiffIFD holds the unsigned integer values of the entries of a TIFF image
+// file directory, indexed by tag.
+type tiffIFD map[uint16][]uint64
+
+// value returns the first value of the entry tag, or def if there is none.
+func (ifd tiffIFD) value(tag uint16, def uint64) uint64 {
+	if vs := ifd[tag]; len(vs) > 0 {
+		return vs[0]
+	}
+	return def
+}
+
+// values returns the values of the entry tag.
+func (ifd tiffIFD) values(tag uint16) []uint64 {
+	return ifd[tag]
+}
+
+// readTIFFIFD reads the first image file directory of the TIFF image raw,
+// keeping the entries holding unsigned integers, and returns it with the
+// byte order of the image.
+func readTIFFIFD(raw []byte) (tiffIFD, binary.ByteOrder, error) {
+	if len(raw) < 8 {
+		return nil, nil, fmt.Errorf("invalid TIFF header")
+	}
+	var bo binary.ByteOrder
+	switch string(raw[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("invalid TIFF header")
+	}
+
+	off := uint64(bo.Uint32(raw[4:8]))
+	if off+2 > uint64(len(raw)) {
+		return nil, nil, fmt.Errorf("invalid TIFF IFD offset")
+	}
+	n := uint64(bo.Uint16(raw[off:]))
+	if off+2+12*n > uint64(len(raw)) {
+		return nil, nil, fmt.Errorf("truncated TIFF IFD")
+	}
+
+	ifd := make(tiffIFD, n)
+	for i := uint64(0); i < n; i++ {
+		var (
+			e     = raw[off+2+12*i:]
+			tag   = bo.Uint16(e[0:])
+			typ   = bo.Uint16(e[2:])
+			count = uint64(bo.Uint32(e[4:]))
+			size  uint64
+		)
+		switch typ {
+		case 1: // BYTE
+			size = 1
+		case 3: // SHORT
+			size = 2
+		case 4: // LONG
+			size = 4
+		default:
+			continue
+		}
+		data := e[8:12]
+		if count*size > 4 {
+			p := uint64(bo.Uint32(e[8:]))
+			if p+count*size > uint64(len(raw)) || p+count*size < p {
+				return nil, nil, fmt.Errorf("invalid TIFF IFD entry %d", tag)
+			}
+			data = raw[p : p+count*size]
+		}
+		vs := make([]uint64, count)
+		for j := range vs {
+			switch size {
+			case 1:
+				vs[j] = uint64(data[j])
+			case 2:
+				vs[j] = uint64(bo.Uint16(data[2*j:]))
+			case 4:
+				vs[j] = uint64(bo.Uint32(data[4*j:]))
+			}
+		}
+		ifd[tag] = vs
+	}
+	return ifd, bo, nil
+}
+
+// floatDiff compares the floating-point images f1 and f2.
+// Per-pixel differences are the absolute differences of the samples,
+// normalized by the range opts.Range (the range of the samples of both
+// images if nil), and rendered as a heatmap, or as contours drawn over the
+// grayscale rendering of f1.
+// A pixel missing from only one of the images (NaN) differs maximally.
+//
+// Only the options independent of colors apply: floatDiff fails with the
+// others.
+func floatDiff(ctx context.Context, f1, f2 *floatImage, opts Options) (Result, error) {
+	defer timed("floatDiff", time.Now())
+
+	if name := floatUnsupported(opts); name != "" {
+		return Result{}, fmt.Errorf("-%s is not supported with floating-point images", name)
+	}
+
+	lo, hi := math.Min(f1.Lo, f2.Lo), math.Max(f1.Hi, f2.Hi)
+	if opts.Range != nil {
+		lo, hi = opts.Range[0], opts.Range[1]
+	}
+	scale := hi - lo
+	if scale <= 0 {
+		scale = 1
+	}
+
+	var (
+		r1  = f1.Bounds()
+		r2  = f2.Bounds()
+		bnd = r1.Intersect(r2)
+		st  = newDiffStats(r1.Union(r2), bnd, opts)
+	)
+	for x := bnd.Min.X; x < bnd.Max.X; x++ {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+		for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+			if st.ignored(x, y) {
+				continue
+			}
+			var (
+				v1 = f1.FloatAt(x, y)
+				v2 = f2.FloatAt(x, y)
+				vd = 0.0
+			)
+			switch nan1, nan2 := math.IsNaN(v1), math.IsNaN(v2); {
+			case nan1 && nan2:
+			case nan1 || nan2:
+				vd = 1
+			default:
+				vd = math.Min(math.Abs(v1-v2)/scale, 1)
+			}
+			st.record(x, y, vd)
+		}
+	}
+	nsmall := st.flush()
+
+	res := Result{
+		Compared: bnd.Dx()*bnd.Dy() - st.nign,
+		Range:    []float64{lo, hi},
+		Small:    nsmall,
+	}
+	st.result(&res)
+	for i, f := range []*floatImage{f1, f2} {
+		if v, ok := f.uniform(); ok {
+			res.Warnings = append(res.Warnings, uniformWarning(i, fmt.Sprintf("single value %g", v)))
+		}
+	}
+	if diff := st.diff; diff != nil {
+		if opts.Regions {
+			res.Regions = findRegions(diff, math.Max(histThreshold(opts), 0))
+		}
+		heat := opts
+		heat.Heatmap = true
+		var ref *image.RGBA // background of the contours
+		if len(opts.Contours) > 0 {
+			ref = rgbaFrom(f1, false)
+		}
+		res.Values = diff
+		res.Diff = renderDiff(diff, ref, nil, st.dmax(), heat)
+		if len(res.Regions) > 0 {
+			res.Diff = drawRegions(res.Diff, res.Regions)
+		}
+	}
+	return res, nil
+}
+
+// floatUnsupported returns the name of the first option set in opts which
+// does not apply to floating-point images, or "" if there is none.
+func floatUnsupported(opts Options) string {
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"metric", opts.Metric != "" && opts.Metric != metricYIQ},
+		{"metric-cmd", opts.MetricCmd != ""},
+		{"weights", opts.Weights != nil},
+		{"units", opts.Units != "" && opts.Units != unitsYIQ},
+		{"alpha-threshold", opts.AlphaThreshold > 0},
+		{"ignore-color", opts.IgnoreColor != nil},
+		{"premultiplied", opts.Premultiplied != "" && opts.Premultiplied != premulNone},
+		{"common-model", opts.CommonModel != "" && opts.CommonModel != modelNone},
+		{"channels", opts.Channels != "" && opts.Channels != channelsAll},
+		{"size-mismatch", opts.SizeMismatch != "" && opts.SizeMismatch != mismatchIgnore},
+		{"align", opts.Align > 0},
+		{"dpr", opts.DPR != 0 && opts.DPR != 1},
+		{"blur", opts.Blur > 0},
+		{"equalize", opts.Equalize},
+		{"aa", opts.AntiAliasing},
+		{"palette", opts.Palette > 0},
+		{"bit-depth-report", opts.BitDepth},
+		{"classify", opts.Classify},
+		{"cvd", opts.CVD != "" && opts.CVD != cvdNone},
+		{"sample", opts.Sample > 0 && opts.Sample < 1},
+	} {
+		if o.set {
+			return o.name
+		}
+	}
+	return ""
+}
+
+// uniform returns the sample of img if all its samples are equal.
+func (img *floatImage) uniform() (float64, bool) {
+	if len(img.Pix) == 0 {
+		return 0, false
+	}
+	v0 := img.Pix[0]
+	for _, v := range img.Pix[1:] {
+		if v != v0 && !(math.IsNaN(v) && math.IsNaN(v0)) {
+			return 0, false
+		}
+	}
+	return v0, true
+}
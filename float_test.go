@@ -0,0 +1,230 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestFloatDiff(t *testing.T) {
+	const (
+		w = 16
+		h = 8
+	)
+	var (
+		pix1 = make([]float32, w*h)
+		pix2 = make([]float32, w*h)
+	)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			pix1[y*w+x] = float32(x + y)
+			pix2[y*w+x] = float32(x + y)
+		}
+	}
+	// samples range over [0, 22]: differences are normalized by 22.
+	pix2[2*w+3] += 4.4 // 0.2
+	pix2[6*w+12] = float32(math.NaN())
+	for _, p := range []image.Point{{8, 1}, {9, 1}, {8, 2}, {9, 2}} {
+		pix2[p.Y*w+p.X] += 2.2 // 0.1
+	}
+
+	f1 := decodeTestTIFF(t, w, h, pix1)
+	f2 := decodeTestTIFF(t, w, h, pix2)
+
+	for _, tc := range []struct {
+		name    string
+		opts    Options
+		max     float64
+		changed int
+		check   func(t *testing.T, res Result)
+	}{
+		{name: "default", max: 1, changed: 6},
+		{name: "heatmap", opts: Options{Heatmap: true, Legend: true, HeatMax: -1}, max: 1, changed: 6},
+		{name: "invert", opts: Options{Invert: true, HeatMax: -1}, max: 1, changed: 6},
+		{name: "contours", opts: Options{Contours: []float64{0.1, 0.5}}, max: 1, changed: 6},
+		{name: "contours-legend", opts: Options{Contours: []float64{0.1, 0.5}, Legend: true}, max: 1, changed: 6},
+		{
+			name: "stats-only", opts: Options{StatsOnly: true}, max: 1, changed: 6,
+			check: func(t *testing.T, res Result) {
+				if res.Diff != nil || res.Hist != nil {
+					t.Errorf("unexpected difference image or histogram")
+				}
+			},
+		},
+		{
+			name: "npy", opts: Options{NPYOut: "diff.npy"}, max: 1, changed: 6,
+			check: func(t *testing.T, res Result) {
+				if res.Exact == nil {
+					t.Fatalf("missing unquantized differences")
+				}
+				if got, want := float64(res.Exact.Pix[2*w+3]), 0.2; math.Abs(got-want) > 1e-6 {
+					t.Errorf("invalid difference: got=%g, want=%g", got, want)
+				}
+			},
+		},
+		{
+			name: "ignore-border", opts: Options{IgnoreBorder: border{2, 2, 2, 2}}, max: 0.2, changed: 3,
+			check: func(t *testing.T, res Result) {
+				if got, want := res.Ignored, w*h-12*4; got != want {
+					t.Errorf("invalid ignored pixels: got=%d, want=%d", got, want)
+				}
+				if got, want := res.Compared, 12*4; got != want {
+					t.Errorf("invalid compared pixels: got=%d, want=%d", got, want)
+				}
+			},
+		},
+		{
+			name: "min-area", opts: Options{MinArea: 2}, max: 0.1, changed: 4,
+			check: func(t *testing.T, res Result) {
+				if got, want := res.Small, 2; got != want {
+					t.Errorf("invalid small pixels: got=%d, want=%d", got, want)
+				}
+			},
+		},
+		{
+			name: "regions", opts: Options{Regions: true}, max: 1, changed: 6,
+			check: func(t *testing.T, res Result) {
+				if got, want := len(res.Regions), 3; got != want {
+					t.Errorf("invalid regions: got=%d, want=%d", got, want)
+				}
+			},
+		},
+		{
+			name: "grid", opts: Options{Grid: image.Pt(2, 1)}, max: 1, changed: 6,
+			check: func(t *testing.T, res Result) {
+				if len(res.Grid) != 1 || len(res.Grid[0]) != 2 {
+					t.Fatalf("invalid grid: %v", res.Grid)
+				}
+				if res.Grid[0][0] >= res.Grid[0][1] {
+					t.Errorf("invalid grid: %v", res.Grid)
+				}
+			},
+		},
+		{
+			name: "max-per-region", opts: Options{Zones: []zone{{Rect: image.Rect(0, 0, 6, 6), Max: 0.5}}}, max: 1, changed: 6,
+			check: func(t *testing.T, res Result) {
+				if len(res.Zones) != 1 || math.Abs(res.Zones[0].DMax-0.2) > 1e-6 {
+					t.Errorf("invalid zones: %v", res.Zones)
+				}
+				if res.Rest != 1 {
+					t.Errorf("invalid rest: got=%g, want=1", res.Rest)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := imageDiffContext(context.Background(), f1, f2, tc.opts)
+			if err != nil {
+				t.Fatalf("could not compare images: %+v", err)
+			}
+			if math.Abs(res.Max-tc.max) > 1e-6 {
+				t.Errorf("invalid max: got=%g, want=%g", res.Max, tc.max)
+			}
+			if res.Changed != tc.changed {
+				t.Errorf("invalid changed pixels: got=%d, want=%d", res.Changed, tc.changed)
+			}
+			if !tc.opts.StatsOnly {
+				if res.Diff == nil {
+					t.Fatalf("missing difference image")
+				}
+				if bnd := res.Diff.Bounds(); bnd.Dx() < w || bnd.Dy() < h {
+					t.Errorf("invalid difference image bounds: %v", bnd)
+				}
+			}
+			if tc.check != nil {
+				tc.check(t, res)
+			}
+		})
+	}
+}
+
+func TestFloatDiffUnsupported(t *testing.T) {
+	var (
+		f1 = decodeTestTIFF(t, 2, 2, []float32{0, 1, 2, 3})
+		f2 = decodeTestTIFF(t, 2, 2, []float32{0, 1, 2, 4})
+	)
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"metric", Options{Metric: metricNCC}},
+		{"units", Options{Units: unitsLevels}},
+		{"ignore-color", Options{IgnoreColor: &color.NRGBA{A: 0xff}}},
+		{"alpha-threshold", Options{AlphaThreshold: 0.5}},
+		{"aa", Options{AntiAliasing: true}},
+		{"size-mismatch", Options{SizeMismatch: mismatchFill}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := imageDiffContext(context.Background(), f1, f2, tc.opts)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+// decodeTestTIFF encodes the w×h samples pix as an uncompressed
+// little-endian 32-bit floating-point TIFF image, and decodes it.
+func decodeTestTIFF(t *testing.T, w, h int, pix []float32) *floatImage {
+	t.Helper()
+
+	type entry struct {
+		tag, typ uint16
+		v        uint32
+	}
+	const (
+		short = 3
+		long  = 4
+	)
+	entries := []entry{
+		{tiffImageWidth, long, uint32(w)},
+		{tiffImageLength, long, uint32(h)},
+		{tiffBitsPerSample, short, 32},
+		{tiffCompression, short, tiffCompressionNone},
+		{tiffStripOffsets, long, 0}, // set below.
+		{tiffSamplesPerPixel, short, 1},
+		{tiffStripByteCounts, long, uint32(4 * len(pix))},
+		{tiffSampleFormat, short, tiffSampleFormatFloat},
+	}
+	entries[4].v = uint32(8 + 2 + 12*len(entries) + 4)
+
+	var (
+		buf = new(bytes.Buffer)
+		le  = binary.LittleEndian
+	)
+	buf.WriteString("II")
+	binary.Write(buf, le, uint16(42))
+	binary.Write(buf, le, uint32(8))
+	binary.Write(buf, le, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, le, e.tag)
+		binary.Write(buf, le, e.typ)
+		binary.Write(buf, le, uint32(1))
+		switch e.typ {
+		case short:
+			binary.Write(buf, le, uint16(e.v))
+			binary.Write(buf, le, uint16(0))
+		default:
+			binary.Write(buf, le, e.v)
+		}
+	}
+	binary.Write(buf, le, uint32(0))
+	binary.Write(buf, le, pix)
+
+	img, ok, err := decodeFloatTIFF(buf.Bytes())
+	switch {
+	case err != nil:
+		t.Fatalf("could not decode TIFF: %+v", err)
+	case !ok:
+		t.Fatalf("TIFF image not decoded as floating-point")
+	}
+	return img
+}
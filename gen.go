@@ -0,0 +1,102 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"os"
+)
+
+// runGen runs the gen sub-command, generating a deterministic pseudo-random
+// image.
+func runGen(args []string) {
+	fset := flag.NewFlagSet("gen", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: img-diff gen [options] out.png\n\nOptions:\n")
+		fset.PrintDefaults()
+	}
+
+	var (
+		size   = fset.String("size", "256x256", "size of the generated image (WxH)")
+		seed   = fset.Int64("seed", 1234, "seed of the pseudo-random number generator")
+		shapes = fset.Int("shapes", 10, "number of shapes to draw")
+	)
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		fatalf("missing output image")
+	}
+
+	var w, h int
+	_, err := fmt.Sscanf(*size, "%dx%d", &w, &h)
+	if err != nil || w <= 0 || h <= 0 {
+		fatalf("invalid -size value %q", *size)
+	}
+
+	img := genImage(w, h, *shapes, *seed)
+	err = saveImage(fset.Arg(0), img, Options{JPEGQuality: 100})
+	if err != nil {
+		fatalf("could not save image: %+v", err)
+	}
+}
+
+// genImage returns a w x h image filled with n pseudo-random rectangles and
+// disks, generated from the provided seed.
+func genImage(w, h, n int, seed int64) *image.RGBA {
+	var (
+		rnd = rand.New(rand.NewSource(seed))
+		img = image.NewRGBA(image.Rect(0, 0, w, h))
+	)
+
+	rndColor := func() color.RGBA {
+		return color.RGBA{
+			R: uint8(rnd.Intn(256)),
+			G: uint8(rnd.Intn(256)),
+			B: uint8(rnd.Intn(256)),
+			A: 255,
+		}
+	}
+
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: rndColor()}, image.Point{}, draw.Src)
+	for i := 0; i < n; i++ {
+		var (
+			c  = rndColor()
+			x0 = rnd.Intn(w)
+			y0 = rnd.Intn(h)
+			x1 = x0 + 1 + rnd.Intn(w/2+1)
+			y1 = y0 + 1 + rnd.Intn(h/2+1)
+			r  = image.Rect(x0, y0, x1, y1).Intersect(img.Bounds())
+		)
+		switch rnd.Intn(2) {
+		case 0:
+			draw.Draw(img, r, &image.Uniform{C: c}, image.Point{}, draw.Src)
+		default:
+			var (
+				cx  = (r.Min.X + r.Max.X) / 2
+				cy  = (r.Min.Y + r.Max.Y) / 2
+				rad = r.Dx() / 2
+			)
+			if r.Dy()/2 < rad {
+				rad = r.Dy() / 2
+			}
+			for y := cy - rad; y <= cy+rad; y++ {
+				for x := cx - rad; x <= cx+rad; x++ {
+					dx, dy := x-cx, y-cy
+					if dx*dx+dy*dy <= rad*rad {
+						img.SetRGBA(x, y, c)
+					}
+				}
+			}
+		}
+	}
+
+	return img
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+)
+
+// gridTileSize is the size, in pixels, of the tiles of the rendered grid.
+const gridTileSize = 32
+
+// parseGrid parses a grid layout of the form "NxM", with N columns and
+// M rows.
+func parseGrid(s string) (image.Point, error) {
+	var g image.Point
+	_, err := fmt.Sscanf(s, "%dx%d", &g.X, &g.Y)
+	if err != nil {
+		return g, fmt.Errorf("could not parse grid %q: %w", s, err)
+	}
+	if g.X <= 0 || g.Y <= 0 {
+		return g, fmt.Errorf("invalid grid dimensions %dx%d", g.X, g.Y)
+	}
+	return g, nil
+}
+
+// tileGrid accumulates per-pixel differences into the tiles of a grid
+// dividing an image.
+type tileGrid struct {
+	bnd  image.Rectangle
+	size image.Point // number of columns and rows
+	sum  []float64
+	n    []float64
+}
+
+func newTileGrid(bnd image.Rectangle, size image.Point) *tileGrid {
+	return &tileGrid{
+		bnd:  bnd,
+		size: size,
+		sum:  make([]float64, size.X*size.Y),
+		n:    make([]float64, size.X*size.Y),
+	}
+}
+
+// fill adds the difference v of the pixel at (x, y) to its tile.
+func (g *tileGrid) fill(x, y int, v float64) {
+	var (
+		i = (x - g.bnd.Min.X) * g.size.X / g.bnd.Dx()
+		j = (y - g.bnd.Min.Y) * g.size.Y / g.bnd.Dy()
+		k = j*g.size.X + i
+	)
+	g.sum[k] += v
+	g.n[k]++
+}
+
+// means returns the mean difference of each tile, row by row.
+func (g *tileGrid) means() [][]float64 {
+	means := make([][]float64, g.size.Y)
+	for j := range means {
+		means[j] = make([]float64, g.size.X)
+		for i := range means[j] {
+			k := j*g.size.X + i
+			if g.n[k] > 0 {
+				means[j][i] = g.sum[k] / g.n[k]
+			}
+		}
+	}
+	return means
+}
+
+// maxTile returns the column and row of the tile of grid with the largest
+// mean difference.
+func maxTile(grid [][]float64) image.Point {
+	var (
+		max = -math.MaxFloat64
+		pos image.Point
+	)
+	for j, row := range grid {
+		for i, v := range row {
+			if v > max {
+				max = v
+				pos = image.Pt(i, j)
+			}
+		}
+	}
+	return pos
+}
+
+// writeGrid prints the mean differences of grid to w, as a matrix.
+func writeGrid(w io.Writer, grid [][]float64) {
+	if len(grid) == 0 {
+		return
+	}
+	pos := maxTile(grid)
+	fmt.Fprintf(w, "grid=%dx%d, max=(%d, %d)\n", len(grid[0]), len(grid), pos.X, pos.Y)
+	for _, row := range grid {
+		vs := make([]string, len(row))
+		for i, v := range row {
+			vs[i] = fmt.Sprintf("%-12.6g", v)
+		}
+		fmt.Fprintf(w, "  %s\n", strings.TrimSpace(strings.Join(vs, " ")))
+	}
+}
+
+// renderGrid renders the mean differences of grid as a coarse heatmap,
+// with tiles of gridTileSize pixels, the largest mean being mapped to the
+// hottest color.
+func renderGrid(grid [][]float64, invert bool) *image.RGBA {
+	if len(grid) == 0 {
+		return image.NewRGBA(image.Rectangle{})
+	}
+
+	var (
+		lut = heatLUT(invert)
+		max = 0.0
+		dst = image.NewRGBA(image.Rect(0, 0, len(grid[0])*gridTileSize, len(grid)*gridTileSize))
+	)
+	for _, row := range grid {
+		for _, v := range row {
+			max = math.Max(max, v)
+		}
+	}
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			t := 0.0
+			if max > 0 {
+				t = grid[y/gridTileSize][x/gridTileSize] / max
+			}
+			dst.SetRGBA(x, y, lut[int(math.Round(t*(heatColors-1)))])
+		}
+	}
+	return dst
+}
@@ -6,6 +6,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
@@ -13,17 +15,22 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
-	"log"
+	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gioui.org/app"
 	"gioui.org/f32"
 	"gioui.org/font/gofont"
 	"gioui.org/gpu/headless"
+	"gioui.org/io/event"
 	"gioui.org/io/key"
+	"gioui.org/io/pointer"
 	"gioui.org/io/system"
 	"gioui.org/layout"
 	"gioui.org/op"
@@ -35,6 +42,7 @@ import (
 	"gioui.org/widget/material"
 	"go-hep.org/x/hep/hbook"
 	"go-hep.org/x/hep/hplot"
+	xdraw "golang.org/x/image/draw"
 	"golang.org/x/image/tiff"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/vg"
@@ -50,40 +58,416 @@ const (
 	height = 800
 )
 
+// previewSize is the maximal size, in pixels, of the displayed images.
+// Larger images are downsampled for display, the comparison being always
+// performed at full resolution.
+const previewSize = 1024
+
 var (
 	defaultMargin = unit.Dp(10)
 )
 
+// Options configures how images are compared, displayed and saved.
+type Options struct {
+	HistLinear   bool      // display the histogram with a linear Y axis
+	HistSkipZero bool      // exclude matching pixels from the histogram
+	SkipZero     bool      // exclude matching pixels from the mean and standard deviation
+	Weights      []float64 // weights of the Y, I and Q channels (nil for the default ones)
+
+	Max  float64 // maximum allowed difference in batch mode
+	Warn float64 // difference above which a warning is printed in batch mode (disabled if negative)
+
+	Format string // output format of batch mode
+
+	Metric        string  // name of the comparison metric
+	MetricCmd     string  // command line of an external program computing a global metric, if any
+	Units         string  // units of the differences of the yiq metric (yiq, jnd, levels)
+	MaskThreshold float64 // luminance above which pixels belong to a mask (hausdorff metric)
+
+	Range []float64 // normalization range (min, max) of floating-point images (nil for the range of their samples)
+
+	Invert    bool      // display matching pixels in white and differences in black
+	Heatmap   bool      // display differences with a color map
+	HeatMin   float64   // difference mapped to the first color of the heatmap
+	HeatMax   float64   // difference mapped to the last color of the heatmap (maximal difference if negative)
+	Contours  []float64 // levels of the iso-difference lines drawn over the reference image, if any
+	Legend    bool      // add a legend below the difference image
+	StatsOnly bool      // only compute statistics, without difference image nor histogram
+
+	AlphaThreshold float64 // alpha, in [0, 1], below which pixels of both images are considered equal
+
+	IgnoreColor     *color.NRGBA // color of the pixels excluded from the comparison, in either image (disabled if nil)
+	IgnoreTolerance int          // maximal difference, per channel, of the pixels matching IgnoreColor
+	IgnoreBorder    border       // frame of pixels excluded from the comparison, around the compared area
+	Premultiplied   string       // inputs whose color values are stored premultiplied by alpha (none, ref, cand, both)
+	CommonModel     string       // 8-bit color model into which both images are converted before comparison
+	Channels        string       // RGB channels compared, as a subset of "rgb"
+	SizeMismatch    string       // handling of the pixels outside of the intersection of both images (ignore, fail, fill)
+	Fill            color.NRGBA  // color of the missing pixels of the smaller image, with the fill size mismatch handling
+
+	Align int     // maximal translation, in pixels, searched to align the images
+	DPR   float64 // device pixel ratio by which the larger image is downscaled
+	Blur  float64 // standard deviation, in pixels, of the Gaussian smoothing of both images (disabled if zero)
+
+	Equalize bool // equalize the luminance histograms of both images
+
+	AntiAliasing bool // ignore differences due to antialiasing
+	AARadius     int  // radius of the neighborhood used to detect antialiasing
+
+	Palette  int    // number of dominant colors compared (disabled if zero)
+	BitDepth bool   // report differences explained by a lower bit depth
+	Regions  bool   // outline the connected regions of differing pixels
+	Classify bool   // guess the type of change between the images
+	MinArea  int    // minimal area, in pixels, of the regions of differences above the threshold (smaller ones are ignored)
+	Zones    []zone // rectangles with their own maximum allowed differences, if any
+	CVD      string // color vision deficiency simulated to compare the images a second time (none, protan, deutan, tritan)
+
+	Sample     float64 // fraction of the pixels randomly sampled for approximate comparisons (all pixels if zero or one)
+	SampleSeed int64   // seed of the random sampling of pixels
+
+	Grid image.Point // number of columns and rows of the grid of tiles whose mean differences are computed (disabled if zero)
+
+	Output       string  // file name of screenshots
+	OutputScale  float64 // scale factor of screenshots, relative to the window
+	OutputLayout string  // arrangement of the panels of the GUI and of screenshots (vertical, horizontal, grid)
+	DiffOut      string  // file name of the difference image, in batch mode
+	HistOut      string  // file name of the histogram image, in batch mode
+	GridOut      string  // file name of the rendered grid of tiles, in batch mode
+	HTMLOut      string  // file name of the HTML report, in batch mode
+	NPYOut       string  // file name of the per-pixel differences, as a NumPy array, in batch mode
+	JSONOut      string  // file name of the JSON summary the results are appended to, in batch mode
+	CropToDiff   bool    // crop the saved difference image to the differing pixels
+	CropMargin   int     // margin, in pixels, around the differing pixels of cropped difference images
+	JPEGQuality  int     // quality of JPEG encoded images, in [1, 100]
+
+	Progress    bool  // print the progress of multi-pair comparisons to stderr
+	SummaryOnly bool  // only print the failing pairs of multi-pair comparisons
+	FailFast    bool  // stop multi-pair comparisons at the first failing pair
+	MaxMemory   int64 // maximal memory, in bytes, needed to compare a pair of images (unlimited if zero)
+
+	Update  string // baselines updated from their candidates in manifest and directory modes (none, failed, all)
+	Retries int    // number of times a failing comparison is retried in batch mode
+
+	OnStrip func(s diffStrip) // called with each rendered strip of differences, as soon as it is computed, if set
+}
+
+// Result holds the outcome of the comparison of 2 images.
+type Result struct {
+	Diff   image.Image   // per-pixel difference image (nil in stats-only mode)
+	Values *image.Gray16 // per-pixel differences, scaled to [0, 0xffff] (nil in stats-only mode)
+	Exact  *floatValues  // unquantized per-pixel differences, if saved with -npy
+	Hist   *hbook.H1D    // distribution of the per-pixel differences (nil in stats-only mode)
+
+	Offset    image.Point // translation applied to the candidate image to align it
+	Aligned   bool        // whether an aligning translation was searched for
+	Scaled    string      // image downscaled by the device pixel ratio, if any
+	DPR       float64     // device pixel ratio applied to the scaled image
+	Blur      float64     // standard deviation of the Gaussian smoothing applied to both images
+	Equalized bool        // whether the luminance histograms of both images were equalized
+
+	Sampled     float64         // fraction of the pixels randomly sampled, for approximate comparisons (zero if exact)
+	Compared    int             // number of compared pixels
+	Changed     int             // number of differing pixels
+	Changes     image.Rectangle // bounding box of the differing pixels
+	AntiAliased int             // number of differing pixels ignored as antialiasing
+	Small       int             // number of differing pixels ignored for belonging to regions smaller than the minimal area
+	Ignored     int             // number of pixels excluded for matching the ignored color or lying in the ignored border
+	Outside     int             // number of pixels compared outside of the intersection of both images
+
+	Min   float64 // minimal non-zero difference
+	Max   float64 // maximal difference
+	Mean  float64 // mean of the per-pixel differences
+	Std   float64 // standard deviation of the per-pixel differences
+	Units string  // units of the differences
+
+	Range []float64 // normalization range of floating-point images, if any
+
+	Metric string  // name of the global metric, if any
+	Score  float64 // value of the global metric
+
+	Attempts int // number of comparisons run, when failing comparisons are retried
+
+	Frames   int      // number of compared frames, for animated images
+	Frame    int      // index of the frame with the largest difference, for animated images
+	Warnings []string // uniform images, and mismatches between animated images
+
+	Regions []region     // connected regions of differing pixels, largest first, if requested
+	Zones   []zoneResult // maximal differences within the zones, if any
+	Rest    float64      // maximal difference outside of the zones, if any
+	Grid    [][]float64  // mean differences of the tiles of the grid, row by row, if requested
+
+	Quantization string // analysis of the bit depths of both images, if requested
+	Change       string // guessed type of change between both images, if requested
+
+	CVD        string  // color vision deficiency simulated to compare both images a second time, if any
+	CVDMax     float64 // maximal difference between the simulated images
+	CVDChanged int     // number of differing pixels of the simulated images
+
+	Palettes    [2][]swatch // dominant colors of both images, if requested
+	PaletteDiff float64     // difference between the dominant colors
+}
+
+// Similarity returns the fraction of the compared pixels that match.
+func (res Result) Similarity() float64 {
+	if res.Compared <= 0 {
+		return 1
+	}
+	return 1 - float64(res.Changed)/float64(res.Compared)
+}
+
+// Value returns the value checked against thresholds: the value of the
+// global metric if any, the maximal per-pixel difference otherwise (of
+// the original or of the color vision deficiency simulated images, and
+// outside of the zones, checked against their own thresholds).
+// Similarity metrics, such as the normalized cross-correlation, are turned
+// into differences: 1-ncc is checked against thresholds.
+func (res Result) Value() float64 {
+	switch res.Metric {
+	case "":
+		if len(res.Zones) > 0 {
+			return math.Max(res.Rest, res.CVDMax)
+		}
+		return math.Max(res.Max, res.CVDMax)
+	case metricNCC:
+		return 1 - res.Score
+	default:
+		return res.Score
+	}
+}
+
 type UI struct {
 	img1 image.Image
 	img2 image.Image
-	diff image.Image
 	hist image.Image
 
-	dmin float64
-	dmax float64
+	res  Result
 	size image.Point
+	opts Options
+
+	// downsampled previews of img1, img2, the diff and its histogram.
+	views struct {
+		img1 paint.ImageOp
+		img2 paint.ImageOp
+		diff paint.ImageOp
+		hist paint.ImageOp
+	}
+
+	cands   []string // file names of the candidate images
+	cur     int      // index of the displayed candidate image
+	swapped bool     // whether the candidate is displayed and compared as img1
+
+	noHist bool // whether the histogram panel is hidden
+
+	tiles   bool           // whether differences are displayed strip by strip while being computed
+	strips  chan diffStrip // strips of differences of the in-flight comparison, if displayed
+	partial *image.RGBA    // preview of the strips of differences received so far
+	loupe   bool           // whether the loupe is displayed under the pointer
+
+	// pointer tracks the pointer over the img1, img2 and diff panels.
+	pointer struct {
+		tags  [3]bool     // event tags of the panels
+		panel int         // index of the hovered panel, -1 if none
+		pos   f32.Point   // position of the pointer over the hovered panel
+		at    image.Point // hovered pixel, in image coordinates
+	}
+
+	thr   widget.Float // threshold above which pixels are displayed as different
+	thrOn bool         // whether the diff panel displays the thresholded differences
+
+	cancel context.CancelFunc // cancels the in-flight comparison, if any
+	done   chan Result        // result of the in-flight comparison
+	errc   chan error         // error of the in-flight comparison, if it failed
+	status string             // status of the comparison, if not done
 
 	ctx   layout.Context
 	theme *material.Theme
 }
 
-func NewUI(img1, img2 image.Image) *UI {
-	diff, dmin, dmax, h := imageDiff(img1, img2)
-
-	dims := image.Pt(diff.Bounds().Dx(), diff.Bounds().Dy())
-	hist := histDiff(h, dims)
-
-	return &UI{
+func NewUI(img1, img2 image.Image, opts Options) *UI {
+	ui := &UI{
 		img1:  img1,
 		img2:  img2,
-		diff:  diff,
-		hist:  hist,
-		dmin:  dmin,
-		dmax:  dmax,
 		size:  image.Pt(width, height),
+		opts:  opts,
 		theme: material.NewTheme(gofont.Collection()),
 	}
+	ui.thr.Value = float32(math.Max(0, histThreshold(opts)))
+	ui.pointer.panel = -1
+	return ui
+}
+
+// start starts computing the difference between the displayed images in
+// the background, canceling any in-flight computation.
+// The result is delivered on ui.done, or its error on ui.errc.
+func (ui *UI) start() {
+	ui.stop()
+
+	ui.views.img1 = paint.NewImageOp(preview(ui.img1))
+	ui.views.img2 = paint.NewImageOp(preview(ui.img2))
+
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		done        = make(chan Result, 1)
+		errc        = make(chan error, 1)
+		img1        = ui.img1
+		img2        = ui.img2
+		opts        = ui.opts
+	)
+	ui.cancel = cancel
+	ui.done = done
+	ui.errc = errc
+	ui.status = "computing... (Escape to cancel)"
+
+	if ui.tiles {
+		strips := make(chan diffStrip, 1)
+		ui.strips = strips
+		ui.partial = nil
+		opts.OnStrip = func(s diffStrip) {
+			select {
+			case strips <- s:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	go func() {
+		res, err := imageDiffContext(ctx, img1, img2, opts)
+		switch {
+		case errors.Is(err, context.Canceled):
+			// canceled by stop.
+		case err != nil:
+			errc <- err
+		default:
+			done <- res
+		}
+	}()
+}
+
+// stop cancels the in-flight computation, if any.
+func (ui *UI) stop() {
+	if ui.cancel == nil {
+		return
+	}
+	ui.cancel()
+	ui.cancel = nil
+	ui.done = nil
+	ui.errc = nil
+	ui.strips = nil
+	ui.status = "canceled"
+}
+
+// fail displays the error of the comparison of the displayed images.
+func (ui *UI) fail(err error) {
+	errorf("could not compare images: %+v", err)
+	ui.stop()
+	ui.status = fmt.Sprintf("failed: %v", err)
+}
+
+// update displays the result of the comparison of the displayed images.
+func (ui *UI) update(res Result) {
+	ui.cancel()
+	ui.cancel = nil
+	ui.done = nil
+	ui.errc = nil
+	ui.strips = nil
+	ui.status = ""
+	ui.res = res
+
+	diff := preview(ui.res.Diff)
+	dims := image.Pt(diff.Bounds().Dx(), diff.Bounds().Dy())
+	ui.hist = histDiff(ui.res.Hist, dims, !ui.opts.HistLinear, histThreshold(ui.opts), metricLabel(ui.opts.Metric))
+
+	ui.views.diff = paint.NewImageOp(diff)
+	ui.views.hist = paint.NewImageOp(ui.hist)
+	if ui.thrOn {
+		ui.threshold()
+	}
+}
+
+// threshold displays in the diff panel the pixels whose difference is
+// above the threshold of the slider.
+func (ui *UI) threshold() {
+	ui.thrOn = true
+	if ui.res.Values == nil {
+		return
+	}
+	img := thresholdDiff(ui.res.Values, float64(ui.thr.Value), ui.opts.Invert)
+	ui.views.diff = paint.NewImageOp(preview(img))
+}
+
+// formatPercent formats the fraction v as a percentage with one decimal,
+// rounded down so that only a fraction of 1 shows as 100%.
+func formatPercent(v float64) string {
+	return fmt.Sprintf("%.1f%%", math.Floor(v*1000+1e-9)/10)
+}
+
+// preview returns a downsampled version of img, fitting in a square of
+// previewSize pixels, or img itself if it already fits.
+func preview(img image.Image) image.Image {
+	bnd := img.Bounds()
+	if bnd.Dx() <= previewSize && bnd.Dy() <= previewSize {
+		return img
+	}
+
+	dst := image.NewRGBA(previewBounds(bnd))
+	xdraw.BiLinear.Scale(dst, dst.Bounds(), img, bnd, xdraw.Src, nil)
+	return dst
+}
+
+// previewBounds returns the bounds, from the origin, of the preview of an
+// image with bounds bnd.
+func previewBounds(bnd image.Rectangle) image.Rectangle {
+	max := bnd.Dx()
+	if bnd.Dy() > max {
+		max = bnd.Dy()
+	}
+	if max <= previewSize {
+		return image.Rect(0, 0, bnd.Dx(), bnd.Dy())
+	}
+
+	scale := float64(previewSize) / float64(max)
+	return image.Rect(
+		0, 0,
+		int(math.Round(float64(bnd.Dx())*scale)),
+		int(math.Round(float64(bnd.Dy())*scale)),
+	)
+}
+
+// show displays the i-th candidate image, wrapping around the list of
+// candidates.
+func (ui *UI) show(i int) error {
+	n := len(ui.cands)
+	if n < 2 {
+		return nil
+	}
+	i = (i%n + n) % n
+
+	ref := ui.img1
+	if ui.swapped {
+		ref = ui.img2
+	}
+	img, err := loadCandidate(ui.cands[i], ref)
+	if err != nil {
+		return fmt.Errorf("could not load image %q: %w", ui.cands[i], err)
+	}
+
+	switch {
+	case ui.swapped:
+		ui.img1 = img
+	default:
+		ui.img2 = img
+	}
+	ui.cur = i
+	ui.start()
+	return nil
+}
+
+// swap swaps the displayed reference and candidate images, and compares
+// them again.
+func (ui *UI) swap() {
+	ui.img1, ui.img2 = ui.img2, ui.img1
+	ui.swapped = !ui.swapped
+	ui.start()
 }
 
 func (ui *UI) run() {
@@ -93,7 +477,30 @@ func (ui *UI) run() {
 	)
 	defer win.Close()
 
-	for e := range win.Events() {
+	ui.start()
+	events := win.Events()
+	for {
+		var e event.Event
+		select {
+		case res := <-ui.done:
+			ui.update(res)
+			win.Invalidate()
+			continue
+		case err := <-ui.errc:
+			ui.fail(err)
+			win.Invalidate()
+			continue
+		case s := <-ui.strips:
+			if ui.partial == nil {
+				ui.partial = image.NewRGBA(previewBounds(s.full))
+			}
+			paintStrip(ui.partial, s)
+			ui.views.diff = paint.NewImageOp(ui.partial)
+			win.Invalidate()
+			continue
+		case e = <-events:
+		}
+
 		switch e := e.(type) {
 		case system.FrameEvent:
 			gtx := layout.NewContext(new(op.Ops), e)
@@ -103,45 +510,166 @@ func (ui *UI) run() {
 		case key.Event:
 			switch e.Name {
 			case "Q", key.NameEscape:
+				if e.State != key.Press {
+					continue
+				}
+				if e.Name == key.NameEscape && ui.cancel != nil {
+					ui.stop()
+					win.Invalidate()
+					continue
+				}
+				ui.stop()
 				win.Close()
 
 			case "R":
 				// TODO: rescale/resize
 
+			case key.NameLeftArrow, key.NameRightArrow:
+				if e.State != key.Press {
+					continue
+				}
+				i := ui.cur + 1
+				if e.Name == key.NameLeftArrow {
+					i = ui.cur - 1
+				}
+				err := ui.show(i)
+				if err != nil {
+					errorf("could not show candidate: %+v", err)
+				}
+				win.Invalidate()
+
+			case "C":
+				if e.State != key.Press {
+					continue
+				}
+				win.WriteClipboard(ui.stats())
+
+			case "H":
+				if e.State != key.Press {
+					continue
+				}
+				ui.noHist = !ui.noHist
+				win.Invalidate()
+
+			case "S":
+				if e.State != key.Press {
+					continue
+				}
+				ui.swap()
+				win.Invalidate()
+
+			case "L":
+				if e.State != key.Press {
+					continue
+				}
+				ui.loupe = !ui.loupe
+				win.Invalidate()
+
+			case "D":
+				if e.State != key.Press {
+					continue
+				}
+				err := ui.saveDiff()
+				if err != nil {
+					errorf("could not save difference image: %+v", err)
+				}
+
 			case "F11":
 				err := ui.screenshot()
 				if err != nil {
-					log.Fatalf("could not take screenshot: %+v", err)
+					fatalf("could not take screenshot: %+v", err)
 				}
 			}
 		case system.DestroyEvent:
+			ui.stop()
 			os.Exit(0)
 		}
 	}
 }
 
+// stats returns the statistics of the displayed comparison.
+func (ui *UI) stats() string {
+	txt := fmt.Sprintf(
+		"Similarity: %s\nDiff:\n - min=  %g\n - max=  %g\n - mean= %g\n - std=  %g",
+		formatPercent(ui.res.Similarity()), ui.res.Min, ui.res.Max, ui.res.Mean, ui.res.Std,
+	)
+	if ui.res.Units == unitsJND || ui.res.Units == unitsLevels {
+		txt += "\n - units= " + ui.res.Units
+	}
+	if ui.res.Sampled > 0 {
+		txt += fmt.Sprintf("\n - approximate (%s of pixels sampled)", formatPercent(ui.res.Sampled))
+	}
+	if ui.res.Metric != "" {
+		txt += fmt.Sprintf("\n - %s= %g", ui.res.Metric, ui.res.Score)
+	}
+	if off := ui.res.Offset; ui.res.Aligned || off != (image.Point{}) {
+		txt += fmt.Sprintf("\n - offset= (%d, %d)", off.X, off.Y)
+	}
+	if ui.res.Scaled != scaledNone {
+		txt += fmt.Sprintf("\n - dpr= %g (%s)", ui.res.DPR, ui.res.Scaled)
+	}
+	if ui.res.Equalized {
+		txt += "\n - equalized"
+	}
+	if ui.res.Blur > 0 {
+		txt += fmt.Sprintf("\n - blur= %g", ui.res.Blur)
+	}
+	if ui.res.Quantization != "" {
+		txt += "\n - " + ui.res.Quantization
+	}
+	if ui.res.Change != "" {
+		txt += "\n - change= " + ui.res.Change
+	}
+	if ui.res.CVD != "" {
+		txt += fmt.Sprintf("\n - %s= %g (%d changed)", ui.res.CVD, ui.res.CVDMax, ui.res.CVDChanged)
+	}
+	if ui.opts.Palette > 0 {
+		txt += fmt.Sprintf("\n - palette= %g", ui.res.PaletteDiff)
+	}
+	if ui.swapped {
+		txt += "\n - swapped (candidate compared against reference)"
+	}
+	if ui.pointer.panel >= 0 {
+		txt += fmt.Sprintf("\n - pointer= (%d, %d)", ui.pointer.at.X, ui.pointer.at.Y)
+	}
+	for _, msg := range ui.res.Warnings {
+		txt += "\n - warning: " + msg
+	}
+	if ui.status != "" {
+		txt = fmt.Sprintf("Status: %s\n%s", ui.status, txt)
+	}
+	if ui.res.Grid != nil {
+		pos := maxTile(ui.res.Grid)
+		txt += fmt.Sprintf("\n - grid max= (%d, %d)", pos.X, pos.Y)
+	}
+	if len(ui.cands) > 1 {
+		txt = fmt.Sprintf(
+			"Candidate [%d/%d]: %s\n%s",
+			ui.cur+1, len(ui.cands), ui.cands[ui.cur], txt,
+		)
+	}
+	return txt
+}
+
 func (ui *UI) Layout(gtx C) D {
 	widgets := []layout.Widget{
 		func(gtx C) D {
 			return layout.Center.Layout(
 				gtx,
 				func(gtx C) D {
-					imgs := []image.Image{ui.img1, ui.img2}
+					imgs := []paint.ImageOp{ui.views.img1, ui.views.img2}
 					list := &layout.List{Axis: layout.Horizontal}
 					return list.Layout(gtx, len(imgs),
 						func(gtx C, i int) D {
 							img := imgs[i]
-							scale := ui.xscale(img)
+							scale := ui.xscale(img.Size())
 							return widget.Border{
 								Color: color.NRGBA{A: 255},
 								Width: unit.Dp(2),
 							}.Layout(gtx, func(gtx C) D {
 								return layout.UniformInset(defaultMargin).Layout(
 									gtx,
-									Image{
-										Src:   paint.NewImageOp(img),
-										Scale: scale,
-									}.Layout,
+									ui.tracked(i, img, scale),
 								)
 							})
 						},
@@ -151,10 +679,7 @@ func (ui *UI) Layout(gtx C) D {
 		},
 
 		func(gtx C) D {
-			label := material.H6(
-				ui.theme,
-				fmt.Sprintf("Diff:\n - min= %g\n - max= %g", ui.dmin, ui.dmax),
-			)
+			label := material.H6(ui.theme, ui.stats())
 			label.Font.Variant = text.Variant("Mono")
 			return layout.Center.Layout(
 				gtx,
@@ -162,27 +687,54 @@ func (ui *UI) Layout(gtx C) D {
 			)
 		},
 
+		func(gtx C) D {
+			label := fmt.Sprintf("threshold= %.4f", ui.thr.Value)
+			if u := ui.opts.Units; u == unitsJND || u == unitsLevels {
+				label = fmt.Sprintf("threshold= %.2f %s", toUnits(ui.opts)(float64(ui.thr.Value)), u)
+			}
+			return layout.Flex{Alignment: layout.Middle}.Layout(
+				gtx,
+				layout.Rigid(material.Body1(ui.theme, label).Layout),
+				layout.Flexed(1, func(gtx C) D {
+					dims := material.Slider(ui.theme, &ui.thr, 0, 1).Layout(gtx)
+					if ui.thr.Changed() {
+						ui.threshold()
+						op.InvalidateOp{}.Add(gtx.Ops)
+					}
+					return dims
+				}),
+			)
+		},
+
 		func(gtx C) D {
 			return layout.Center.Layout(
 				gtx,
 				func(gtx C) D {
-					imgs := []image.Image{ui.diff, ui.hist}
+					imgs := []paint.ImageOp{ui.views.diff, ui.views.hist}
+					if ui.noHist {
+						imgs = imgs[:1]
+					}
 					list := &layout.List{Axis: layout.Horizontal}
 					return list.Layout(gtx, len(imgs),
 						func(gtx C, i int) D {
 							img := imgs[i]
-							scale := ui.xscale(img)
+							scale := ui.xscale(img.Size())
+							if ui.noHist {
+								// give the room of the histogram to the diff.
+								scale = 2 * float32(math.Min(
+									float64(ui.xscale(img.Size())),
+									float64(ui.yscale(img.Size())),
+								))
+							}
 							return widget.Border{
 								Color: color.NRGBA{A: 255},
 								Width: unit.Dp(2),
 							}.Layout(gtx, func(gtx C) D {
-								return layout.UniformInset(defaultMargin).Layout(
-									gtx,
-									Image{
-										Src:   paint.NewImageOp(img),
-										Scale: scale,
-									}.Layout,
-								)
+								w := Image{Src: img, Scale: scale}.Layout
+								if i == 0 {
+									w = ui.tracked(2, img, scale)
+								}
+								return layout.UniformInset(defaultMargin).Layout(gtx, w)
 							})
 						},
 					)
@@ -191,62 +743,177 @@ func (ui *UI) Layout(gtx C) D {
 		},
 	}
 
-	list := layout.List{
-		Axis: layout.Vertical,
+	return layoutPanels(gtx, layoutColumns(ui.opts.OutputLayout, len(widgets)), widgets)
+}
+
+// tracked returns a widget displaying img at scale in the i-th tracked
+// panel (img1, img2 or diff), tracking the pointer over it and overlaying
+// the loupe at the pointer, if enabled.
+func (ui *UI) tracked(i int, img paint.ImageOp, scale float32) layout.Widget {
+	return func(gtx C) D {
+		var (
+			tag  = &ui.pointer.tags[i]
+			full = []image.Image{ui.img1, ui.img2, ui.res.Diff}[i]
+		)
+		for _, e := range gtx.Events(tag) {
+			e, ok := e.(pointer.Event)
+			if !ok {
+				continue
+			}
+			switch e.Type {
+			case pointer.Leave, pointer.Cancel:
+				if ui.pointer.panel == i {
+					ui.pointer.panel = -1
+				}
+			default:
+				size := img.Size()
+				if full == nil || size.X == 0 || size.Y == 0 {
+					continue
+				}
+				// map the position over the downsampled preview to the
+				// pixel of the full image.
+				bnd := full.Bounds()
+				ui.pointer.panel = i
+				ui.pointer.pos = e.Position
+				ui.pointer.at = image.Pt(
+					bnd.Min.X+int(e.Position.X/scale)*bnd.Dx()/size.X,
+					bnd.Min.Y+int(e.Position.Y/scale)*bnd.Dy()/size.Y,
+				)
+			}
+			op.InvalidateOp{}.Add(gtx.Ops)
+		}
+
+		dims := Image{Src: img, Scale: scale}.Layout(gtx)
+
+		state := op.Save(gtx.Ops)
+		pointer.Rect(image.Rectangle{Max: dims.Size}).Add(gtx.Ops)
+		pointer.InputOp{
+			Tag:   tag,
+			Types: pointer.Enter | pointer.Move | pointer.Leave,
+		}.Add(gtx.Ops)
+		state.Load()
+
+		if ui.loupe && ui.pointer.panel == i {
+			// draw the loupe on top of all the panels, next to the pointer.
+			macro := op.Record(gtx.Ops)
+			op.Offset(ui.pointer.pos.Add(f32.Pt(16, 16))).Add(gtx.Ops)
+			lp := loupe([]image.Image{ui.img1, ui.img2, ui.res.Diff}, ui.pointer.at)
+			clip.Rect(lp.Bounds()).Add(gtx.Ops)
+			paint.NewImageOp(lp).Add(gtx.Ops)
+			paint.PaintOp{}.Add(gtx.Ops)
+			op.Defer(gtx.Ops, macro.Stop())
+		}
+		return dims
 	}
-	return list.Layout(gtx, len(widgets), func(gtx C, i int) D {
-		return layout.UniformInset(unit.Dp(16)).Layout(gtx, widgets[i])
-	})
 }
 
-func (ui *UI) xscale(img image.Image) float32 {
-	sz := 0.5 * float32(ui.size.X-100)
-	dx := float32(img.Bounds().Dx())
+// panels is the number of panels of the window.
+const panels = 4
+
+// panel returns the size available to each panel of the window.
+func (ui *UI) panel() image.Point {
+	return panelSize(ui.opts.OutputLayout, ui.size, panels)
+}
+
+func (ui *UI) xscale(dims image.Point) float32 {
+	sz := 0.5 * float32(ui.panel().X-100)
+	dx := float32(dims.X)
 	scale := dx / sz
 	return 1 / scale
 }
 
-func (ui *UI) yscale(img image.Image) float32 {
-	sz := 1. / 3. * float32(ui.size.Y)
-	dy := float32(img.Bounds().Dy())
+func (ui *UI) yscale(dims image.Point) float32 {
+	sz := float32(ui.panel().Y)
+	dy := float32(dims.Y)
 	scale := dy / sz
 	return 1 / scale
 }
 
+// screenshotTolerance is the maximal difference between 2 renderings of
+// the same screenshot, above which the rendering is reported as flaky.
+const screenshotTolerance = 1e-3
+
+// screenshot saves a rendering of the window to ui.opts.Output.
+// The window is rendered twice, and a warning is logged if both renderings
+// differ by more than screenshotTolerance.
 func (ui *UI) screenshot() error {
-	head, err := headless.NewWindow(ui.size.X, ui.size.Y)
+	img, err := ui.render()
+	if err != nil {
+		return err
+	}
+	again, err := ui.render()
 	if err != nil {
 		return err
 	}
 
-	gtx := layout.Context{
-		Ops:         new(op.Ops),
-		Constraints: layout.Exact(ui.size),
+	res := imageDiff(img, again, Options{DPR: 1, StatsOnly: true})
+	if res.Max > screenshotTolerance {
+		warnf("nondeterministic screenshot rendering (dmax=%g, changed=%d)", res.Max, res.Changed)
 	}
-	ui.Layout(gtx)
 
-	err = head.Frame(gtx.Ops)
-	if err != nil {
-		return err
+	return saveImage(ui.opts.Output, img, ui.opts)
+}
+
+// diffOut is the file name of the difference images saved from the GUI,
+// unless -diff-out is set.
+const diffOut = "diff.png"
+
+// saveDiff saves the displayed difference image, at full resolution, to
+// ui.opts.DiffOut (diffOut if unset or stdout).
+// The thresholded differences are saved if they are displayed.
+func (ui *UI) saveDiff() error {
+	img := ui.res.Diff
+	if ui.thrOn && ui.res.Values != nil {
+		img = thresholdDiff(ui.res.Values, float64(ui.thr.Value), ui.opts.Invert)
+	}
+	if img == nil {
+		return fmt.Errorf("no difference image to save")
 	}
 
-	img, err := head.Screenshot()
+	name := ui.opts.DiffOut
+	if name == "" || name == "-" {
+		name = diffOut
+	}
+	err := saveImage(name, img, ui.opts)
 	if err != nil {
 		return err
 	}
+	infof("saved difference image to %s", name)
+	return nil
+}
 
-	f, err := os.Create("out.png")
+// render renders the window off-screen, scaled by ui.opts.OutputScale.
+// The window is laid out at its own size, and the resulting operations
+// are scaled, so that text and shapes are rendered at the larger size
+// instead of being upsampled.
+func (ui *UI) render() (image.Image, error) {
+	scale := ui.opts.OutputScale
+	if scale <= 0 {
+		scale = 1
+	}
+	size := image.Pt(
+		int(math.Round(float64(ui.size.X)*scale)),
+		int(math.Round(float64(ui.size.Y)*scale)),
+	)
+	head, err := headless.NewWindow(size.X, size.Y)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
+	defer head.Release()
 
-	err = png.Encode(f, img)
+	gtx := layout.Context{
+		Ops:         new(op.Ops),
+		Constraints: layout.Exact(ui.size),
+	}
+	op.Affine(f32.Affine2D{}.Scale(f32.Pt(0, 0), f32.Pt(float32(scale), float32(scale)))).Add(gtx.Ops)
+	ui.Layout(gtx)
+
+	err = head.Frame(gtx.Ops)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return f.Close()
+	return head.Screenshot()
 }
 
 type Image struct {
@@ -260,6 +927,10 @@ func (img Image) Layout(gtx layout.Context) layout.Dimensions {
 		scale = 160.0 / 72.0
 	}
 	size := img.Src.Size()
+	if size.X == 0 || size.Y == 0 {
+		// nothing to display yet.
+		return layout.Dimensions{}
+	}
 	x := float32(size.X)
 	y := float32(size.Y)
 
@@ -282,6 +953,12 @@ func (img Image) Layout(gtx layout.Context) layout.Dimensions {
 }
 
 func loadImage(name string) (image.Image, error) {
+	defer timed(fmt.Sprintf("loadImage(%q)", name), time.Now())
+
+	if isURL(name) {
+		return fetchImage(name)
+	}
+
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, fmt.Errorf("could not open image file %q: %w", name, err)
@@ -290,18 +967,26 @@ func loadImage(name string) (image.Image, error) {
 
 	switch ext := strings.ToLower(filepath.Ext(name)); ext {
 	case ".png":
-		img, err := png.Decode(f)
+		raw, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read PNG image file %q: %w", name, err)
+		}
+		img, err := png.Decode(bytes.NewReader(raw))
 		if err != nil {
 			return nil, fmt.Errorf("could not decode PNG image file %q: %w", name, err)
 		}
-		return img, nil
+		return convertICC(name, img, raw), nil
 
 	case ".jpeg", ".jpg":
-		img, err := jpeg.Decode(f)
+		raw, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read JPEG image file %q: %w", name, err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(raw))
 		if err != nil {
 			return nil, fmt.Errorf("could not decode JPEG image file %q: %w", name, err)
 		}
-		return img, nil
+		return convertICC(name, img, raw), nil
 
 	case ".gif":
 		img, err := gif.Decode(f)
@@ -311,58 +996,398 @@ func loadImage(name string) (image.Image, error) {
 		return img, nil
 
 	case ".tif", ".tiff":
-		img, err := tiff.Decode(f)
+		raw, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TIFF image file %q: %w", name, err)
+		}
+		raw, err = selectTIFFPage(raw, tiffLayer)
+		if err != nil {
+			return nil, fmt.Errorf("could not select page %q of TIFF image file %q: %w", tiffLayer, name, err)
+		}
+		fimg, ok, err := decodeFloatTIFF(raw)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode TIFF image file %q: %w", name, err)
+		}
+		if ok {
+			return fimg, nil
+		}
+		img, err := tiff.Decode(bytes.NewReader(raw))
 		if err != nil {
 			return nil, fmt.Errorf("could not decode TIFF image file %q: %w", name, err)
 		}
 		return img, nil
 
+	case ".raw":
+		img, err := decodeRaw(f, rawGeom)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode raw image file %q: %w", name, err)
+		}
+		return img, nil
+
+	case ".webp":
+		// animated WebP images are not handled by the webp package.
+		anim, err := decodeWebPAnim(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode WebP image file %q: %w", name, err)
+		}
+		return anim.Frames[0], nil
+
 	default:
 		return nil, fmt.Errorf("unknown image file extension %q", ext)
 	}
 }
 
-func imageDiff(v1, v2 image.Image) (image.Image, float64, float64, *hbook.H1D) {
-	img1, ok := v1.(*image.RGBA)
-	if !ok {
-		img1 = newRGBAFrom(v1)
+// loadCandidate loads the candidate image compared against ref.
+//
+// A name of the form "color:#rrggbb" (or "color:#rrggbbaa") denotes a
+// uniform image of that color, with the same bounds than ref.
+func loadCandidate(name string, ref image.Image) (image.Image, error) {
+	if !strings.HasPrefix(name, "color:") {
+		return loadImage(name)
+	}
+
+	c, err := parseColor(strings.TrimPrefix(name, "color:"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse color image %q: %w", name, err)
+	}
+
+	img := image.NewNRGBA(ref.Bounds())
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: c}, image.Point{}, draw.Src)
+	return img, nil
+}
+
+// parseColor parses a color of the form "#rgb", "#rrggbb" or "#rrggbbaa".
+func parseColor(s string) (color.NRGBA, error) {
+	c := color.NRGBA{A: 0xff}
+	if !strings.HasPrefix(s, "#") {
+		return c, fmt.Errorf("invalid color %q: missing '#' prefix", s)
+	}
+
+	var err error
+	switch hex := s[1:]; len(hex) {
+	case 3:
+		_, err = fmt.Sscanf(hex, "%1x%1x%1x", &c.R, &c.G, &c.B)
+		c.R *= 0x11
+		c.G *= 0x11
+		c.B *= 0x11
+	case 6:
+		_, err = fmt.Sscanf(hex, "%02x%02x%02x", &c.R, &c.G, &c.B)
+	case 8:
+		_, err = fmt.Sscanf(hex, "%02x%02x%02x%02x", &c.R, &c.G, &c.B, &c.A)
+	default:
+		return c, fmt.Errorf("invalid color %q: expected 3, 6 or 8 hexadecimal digits", s)
 	}
+	if err != nil {
+		return c, fmt.Errorf("invalid color %q: %w", s, err)
+	}
+
+	return c, nil
+}
 
-	img2, ok := v2.(*image.RGBA)
-	if !ok {
-		img2 = newRGBAFrom(v2)
+// saveImage saves img to the named file, or to stdout as PNG if name is "-".
+func saveImage(name string, img image.Image, opts Options) error {
+	if name == "-" {
+		// no extension to select a format from: stream PNG.
+		return encodeImage(os.Stdout, "stdout.png", img, opts)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("could not create image file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	err = encodeImage(f, name, img, opts)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close image file %q: %w", name, err)
+	}
+	return nil
+}
+
+// encodeImage encodes img to w, using the format associated with the
+// extension of the provided file name.
+func encodeImage(w io.Writer, name string, img image.Image, opts Options) error {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".png":
+		err := png.Encode(w, img)
+		if err != nil {
+			return fmt.Errorf("could not encode PNG image file %q: %w", name, err)
+		}
+		return nil
+
+	case ".jpeg", ".jpg":
+		// JPEG is a lossy format: low qualities add their own artifacts
+		// on top of the differences being displayed.
+		err := jpeg.Encode(w, img, &jpeg.Options{Quality: opts.JPEGQuality})
+		if err != nil {
+			return fmt.Errorf("could not encode JPEG image file %q: %w", name, err)
+		}
+		return nil
+
+	case ".gif":
+		err := gif.Encode(w, img, nil)
+		if err != nil {
+			return fmt.Errorf("could not encode GIF image file %q: %w", name, err)
+		}
+		return nil
+
+	case ".tif", ".tiff":
+		err := tiff.Encode(w, img, nil)
+		if err != nil {
+			return fmt.Errorf("could not encode TIFF image file %q: %w", name, err)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown image file extension %q", ext)
+	}
+}
+
+// imageDiff compares the images v1 and v2.
+func imageDiff(v1, v2 image.Image, opts Options) Result {
+	res, _ := imageDiffContext(context.Background(), v1, v2, opts)
+	return res
+}
+
+// imageDiffContext compares the images v1 and v2, like imageDiff.
+// It returns early with the error of ctx if ctx is canceled before the
+// comparison completes.
+func imageDiffContext(ctx context.Context, v1, v2 image.Image, opts Options) (Result, error) {
+	if f1, ok := v1.(*floatImage); ok {
+		if f2, ok := v2.(*floatImage); ok {
+			return floatDiff(ctx, f1, f2, opts)
+		}
+	}
+
+	defer timed("imageDiff", time.Now())
+
+	if opts.CommonModel != modelNone {
+		debugf("converting images to %s", opts.CommonModel)
+	}
+	v1 = convertModel(v1, opts.CommonModel)
+	v2 = convertModel(v2, opts.CommonModel)
+
+	var (
+		img1 = rgbaFrom(v1, opts.Premultiplied == premulRef || opts.Premultiplied == premulBoth)
+		img2 = rgbaFrom(v2, opts.Premultiplied == premulCand || opts.Premultiplied == premulBoth)
+	)
+
+	blank := [2]uniformity{imageUniformity(img1), imageUniformity(img2)}
+
+	if opts.Channels != "" && opts.Channels != channelsAll {
+		debugf("comparing the %q channels", opts.Channels)
+		img1 = maskChannels(img1, opts.Channels)
+		img2 = maskChannels(img2, opts.Channels)
+	}
+
+	cmetric := yiqDiff
+	if opts.Weights != nil {
+		cmetric = newYIQDiff(opts.Weights)
+	}
+	metric := pixelMetric(opts)
+
+	var scaled string
+	img1, img2, scaled = applyDPR(img1, img2, opts.DPR)
+	if scaled != scaledNone {
+		debugf("resized %s image by 1/%g", scaled, opts.DPR)
+	}
+
+	if opts.Equalize {
+		debugf("equalizing luminance histograms")
+		img1 = equalize(img1)
+		img2 = equalize(img2)
+	}
+	if opts.Blur > 0 {
+		debugf("blurring images (sigma=%g)", opts.Blur)
+		img1 = gaussianBlur(img1, opts.Blur)
+		img2 = gaussianBlur(img2, opts.Blur)
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	var off image.Point
+	if opts.Align > 0 {
+		off = align(img1, img2, opts.Align, metric)
+		img2 = translate(img2, off)
+		debugf("aligned candidate image by (%d, %d)", off.X, off.Y)
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
 	}
 
-	h := hbook.NewH1D(100, 0, 1)
 	r1 := img1.Bounds()
 	r2 := img2.Bounds()
-	diff := image.NewGray16(r1.Union(r2))
-	draw.Draw(
-		diff, diff.Bounds(),
-		&image.Uniform{C: color.RGBA{A: 255}},
-		image.Point{}, draw.Src,
-	)
 
 	bnd := r1.Intersect(r2)
-	dmin := +math.MaxFloat64
-	dmax := -math.MaxFloat64
+	area := bnd
+	if opts.SizeMismatch != "" && opts.SizeMismatch != mismatchIgnore {
+		area = r1.Union(r2)
+	}
+	st := newDiffStats(r1.Union(r2), area, opts)
+	st.blank = blank
+
+	var (
+		naa  int
+		nout int
+		nskp int // pixels of the intersection left out of an approximate comparison
+		nsko int // pixels outside of the intersection left out of an approximate comparison
+	)
+	// skip returns whether the next pixel is left out of an approximate
+	// comparison.
+	skip := func() bool { return false }
+	if opts.Sample > 0 && opts.Sample < 1 {
+		rnd := rand.New(rand.NewSource(opts.SampleSeed))
+		skip = func() bool { return rnd.Float64() >= opts.Sample }
+	}
+
+	// publish sends the strip of differences ending at column x, once it is
+	// complete, rendered as the final difference image.
+	publish := func(x int) {}
+	if opts.OnStrip != nil && st.diff != nil && st.pending == nil {
+		sopts := opts
+		sopts.Legend = false
+		render := newDiffRenderer(img1, img2, sopts)
+		publish = func(x int) {
+			if x0 := bnd.Min.X + (x-bnd.Min.X)/stripWidth*stripWidth; x+1 == x0+stripWidth || x+1 == bnd.Max.X {
+				sub := st.diff.SubImage(image.Rect(x0, bnd.Min.Y, x+1, bnd.Max.Y)).(*image.Gray16)
+				opts.OnStrip(diffStrip{full: st.diff.Bounds(), img: render(sub, st.dmax())})
+			}
+		}
+	}
 	for x := bnd.Min.X; x < bnd.Max.X; x++ {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
 		for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
-			c1 := img1.RGBAAt(x, y)
-			c2 := img2.RGBAAt(x, y)
-			vd := yiqDiff(c1, c2)
-			h.Fill(vd, 1)
-			if vd > 0 {
-				dmin = math.Min(vd, dmin)
+			if skip() {
+				nskp++
+				continue
+			}
+			vd, ok := st.compare(x, y, img1.RGBAAt(x, y), img2.RGBAAt(x, y))
+			if !ok {
+				continue
 			}
-			dmax = math.Max(vd, dmax)
-			diff.SetGray16(x, y, color.Gray16{Y: uint16(vd * math.MaxUint16)})
+			if vd > 0 && opts.AntiAliasing &&
+				(antialiased(img1, img2, x, y, opts.AARadius) ||
+					antialiased(img2, img1, x, y, opts.AARadius)) {
+				vd = 0
+				naa++
+			}
+			st.record(x, y, vd)
 		}
+		publish(x)
 	}
-	if dmin == math.MaxFloat64 {
-		dmin = 0
+	if area != bnd {
+		fill := color.RGBAModel.Convert(opts.Fill).(color.RGBA)
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if err := ctx.Err(); err != nil {
+				return Result{}, err
+			}
+			for y := area.Min.Y; y < area.Max.Y; y++ {
+				var (
+					p   = image.Pt(x, y)
+					in1 = p.In(r1)
+					in2 = p.In(r2)
+				)
+				if in1 == in2 || !p.In(st.inner) {
+					// compared above, missing from both images or ignored.
+					continue
+				}
+				if skip() {
+					nsko++
+					continue
+				}
+				vd := 1.0
+				if opts.SizeMismatch == mismatchFill {
+					c1, c2 := fill, fill
+					if in1 {
+						c1 = img1.RGBAAt(x, y)
+					} else {
+						c2 = img2.RGBAAt(x, y)
+					}
+					vd = metric(c1, c2)
+				}
+				st.record(x, y, vd)
+				nout++
+			}
+		}
 	}
-	return diff, dmin, dmax, h
+	nsmall := st.flush()
+
+	res := Result{
+		Offset:    off,
+		Aligned:   opts.Align > 0,
+		Scaled:    scaled,
+		Blur:      opts.Blur,
+		Equalized: opts.Equalize,
+		Compared:  bnd.Dx()*bnd.Dy() - st.nign + nout - nskp,
+
+		AntiAliased: naa,
+		Outside:     nout,
+		Small:       nsmall,
+	}
+	st.result(&res)
+	if scaled != scaledNone {
+		res.DPR = opts.DPR
+	}
+	if nskp+nsko > 0 {
+		res.Sampled = opts.Sample
+	}
+	if diff := st.diff; diff != nil {
+		if opts.Regions {
+			res.Regions = findRegions(diff, math.Max(histThreshold(opts), 0))
+		}
+		res.Values = diff
+		res.Diff = renderDiff(diff, img1, img2, st.dmax(), opts)
+		if len(res.Regions) > 0 {
+			res.Diff = drawRegions(res.Diff, res.Regions)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if v, ok := globalMetric(opts.Metric, img1, img2, opts); ok {
+		res.Metric = opts.Metric
+		res.Score = v
+	}
+	if opts.MetricCmd != "" {
+		v, img, err := externalMetric(ctx, opts.MetricCmd, img1, img2)
+		if err != nil {
+			return Result{}, err
+		}
+		res.Metric = metricExternal
+		res.Score = v
+		if img != nil && !opts.StatsOnly {
+			res.Diff = img
+		}
+	}
+	if opts.BitDepth {
+		res.Quantization = quantizationNote(img1, img2)
+	}
+	if opts.Classify {
+		res.Change = classifyChange(img1, img2, st.chg, metric)
+	}
+	if opts.CVD != "" && opts.CVD != cvdNone {
+		res.CVD = opts.CVD
+		res.CVDMax, res.CVDChanged = cvdDiff(img1, img2, bnd, opts.CVD, metric)
+		if st.conv {
+			res.CVDMax = st.units(res.CVDMax)
+		}
+	}
+	if opts.Palette > 0 {
+		res.Palettes[0] = dominantColors(img1, opts.Palette)
+		res.Palettes[1] = dominantColors(img2, opts.Palette)
+		res.PaletteDiff = paletteDiff(res.Palettes[0], res.Palettes[1], cmetric)
+	}
+	return res, nil
 }
 
 // yiqDiff returns the normalized difference between the colors of 2 pixels,
@@ -378,6 +1403,17 @@ func imageDiff(v1, v2 image.Image) (image.Image, float64, float64, *hbook.H1D) {
 func yiqDiff(c1, c2 color.RGBA) float64 {
 	const max = 35215.0 // difference between 2 maximally different pixels.
 
+	var (
+		y, i, q = yiqDelta(c1, c2)
+
+		diff = 0.5053*y*y + 0.299*i*i + 0.1957*q*q
+	)
+	return diff / max
+}
+
+// yiqDelta returns the differences between the Y, I and Q components
+// of the colors of 2 pixels.
+func yiqDelta(c1, c2 color.RGBA) (y, i, q float64) {
 	var (
 		r1 = float64(c1.R)
 		g1 = float64(c1.G)
@@ -394,17 +1430,42 @@ func yiqDiff(c1, c2 color.RGBA) float64 {
 		y2 = r2*0.29889531 + g2*0.58662247 + b2*0.11448223
 		i2 = r2*0.59597799 - g2*0.27417610 - b2*0.32180189
 		q2 = r2*0.21147017 - g2*0.52261711 + b2*0.31114694
+	)
+	return y1 - y2, i1 - i2, q1 - q2
+}
 
-		y = y1 - y2
-		i = i1 - i2
-		q = q1 - q2
+// newYIQDiff returns a function computing the normalized difference between
+// the colors of 2 pixels, in the NTSC YIQ color space, using the provided
+// weights for the Y, I and Q channels.
+func newYIQDiff(w []float64) func(c1, c2 color.RGBA) float64 {
+	// the weighted difference is a convex function of the RGB deltas:
+	// its maximum is reached between opposite corners of the RGB cube.
+	max := 0.0
+	for k := 0; k < 8; k++ {
+		c1 := color.RGBA{
+			R: uint8(k&1) * 255,
+			G: uint8(k>>1&1) * 255,
+			B: uint8(k>>2&1) * 255,
+			A: 255,
+		}
+		c2 := color.RGBA{R: 255 - c1.R, G: 255 - c1.G, B: 255 - c1.B, A: 255}
+		y, i, q := yiqDelta(c1, c2)
+		max = math.Max(max, w[0]*y*y+w[1]*i*i+w[2]*q*q)
+	}
 
-		diff = 0.5053*y*y + 0.299*i*i + 0.1957*q*q
-	)
-	return diff / max
+	return func(c1, c2 color.RGBA) float64 {
+		y, i, q := yiqDelta(c1, c2)
+		return (w[0]*y*y + w[1]*i*i + w[2]*q*q) / max
+	}
 }
 
 func newRGBAFrom(src image.Image) *image.RGBA {
+	defer timed(fmt.Sprintf("newRGBAFrom(%T)", src), time.Now())
+
+	if src, ok := src.(*image.CMYK); ok {
+		return newRGBAFromCMYK(src)
+	}
+
 	var (
 		bnds = src.Bounds()
 		dst  = image.NewRGBA(bnds)
@@ -413,36 +1474,66 @@ func newRGBAFrom(src image.Image) *image.RGBA {
 	return dst
 }
 
-func histDiff(h *hbook.H1D, dims image.Point) image.Image {
+// histThreshold returns the pass/fail threshold to overlay on the histogram
+// of per-pixel differences, or a negative value if there is none.
+func histThreshold(opts Options) float64 {
+	max := fromUnits(opts)(opts.Max)
+	if opts.Metric == metricHausdorff || opts.Metric == metricNCC || opts.Metric == metricEMD || max <= 0 || max > 1 {
+		return -1
+	}
+	return max
+}
+
+// histDiff renders the distribution of differences of the named quantity.
+// A vertical line is drawn at max, if positive.
+func histDiff(h *hbook.H1D, dims image.Point, logy bool, max float64, name string) image.Image {
+	defer timed("histDiff", time.Now())
+
 	p := hplot.New()
-	p.Title.Text = "YIQ distribution"
-	p.X.Label.Text = "delta(YIQ)"
-	p.Y.Scale = plot.LogScale{}
-	p.Y.Tick.Marker = plot.LogTicks{}
+	p.Title.Text = name + " distribution"
+	p.X.Label.Text = "delta(" + name + ")"
+	if h.Entries() == 0 {
+		// a log scale can not display an empty histogram.
+		logy = false
+	}
+	switch {
+	case logy:
+		p.Y.Scale = plot.LogScale{}
+		p.Y.Tick.Marker = plot.LogTicks{}
+	default:
+		p.Y.Tick.Marker = hplot.Ticks{N: 10}
+	}
 
 	hh := hplot.NewH1D(h)
 	hh.LineStyle.Color = color.RGBA{B: 255, A: 255}
-	hh.LogY = true
+	hh.LogY = logy
 	p.Add(hh, hplot.NewGrid())
 
+	if max > 0 {
+		vl := hplot.VLine(max, nil, nil)
+		vl.Line.Color = color.RGBA{R: 255, A: 255}
+		vl.Line.Dashes = []vg.Length{vg.Points(4), vg.Points(2)}
+		p.Add(vl)
+	}
+
 	x := vg.Length(dims.X)
 	y := vg.Length(dims.Y)
 	canvas, err := p.WriterTo(x, y, "png")
 	if err != nil {
-		log.Printf("could not create writer-to plot: %+v", err)
+		errorf("could not create writer-to plot: %+v", err)
 		return nil
 	}
 
 	buf := new(bytes.Buffer)
 	_, err = canvas.WriteTo(buf)
 	if err != nil {
-		log.Printf("could not write plot: %+v", err)
+		errorf("could not write plot: %+v", err)
 		return nil
 	}
 
 	img, err := png.Decode(buf)
 	if err != nil {
-		log.Printf("could not encode plot plot: %+v", err)
+		errorf("could not encode plot plot: %+v", err)
 		return nil
 	}
 
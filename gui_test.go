@@ -0,0 +1,45 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func BenchmarkImageDiff(b *testing.B) {
+	for _, metric := range []string{metricYIQ, metricHausdorff} {
+		for _, size := range []int{64, 256, 1024} {
+			var (
+				img1 = newBenchImage(size, 1)
+				img2 = newBenchImage(size, 2)
+				opts = Options{Metric: metric}
+			)
+			b.Run(fmt.Sprintf("metric=%s/size=%d", metric, size), func(b *testing.B) {
+				b.SetBytes(int64(len(img1.Pix)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = imageDiff(img1, img2, opts)
+				}
+			})
+		}
+	}
+}
+
+// newBenchImage returns a deterministic pseudo-random square image.
+func newBenchImage(size int, seed int64) *image.RGBA {
+	var (
+		rnd = rand.New(rand.NewSource(seed))
+		img = image.NewRGBA(image.Rect(0, 0, size, size))
+	)
+	rnd.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
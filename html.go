@@ -0,0 +1,140 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"os"
+)
+
+// htmlEntry is the comparison of a pair of images in an HTML report.
+type htmlEntry struct {
+	Ref    string
+	Cand   string
+	Status string      // PASS, WARN, FAIL or ERROR
+	Stats  string      // statistics, as printed in batch mode
+	Images []htmlImage // embedded images
+}
+
+// htmlImage is an image embedded in an HTML report.
+type htmlImage struct {
+	Title string
+	Src   template.URL // PNG data URI
+}
+
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>img-diff report</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+section { border-top: 1px solid #ccc; padding: 1em 0; }
+figure { display: inline-block; margin: 0 1em 1em 0; vertical-align: top; }
+figcaption { font-size: small; color: #555; }
+img { max-width: 512px; border: 1px solid #ccc; image-rendering: pixelated; }
+.PASS { color: #2a2; } .WARN { color: #c80; } .FAIL, .ERROR { color: #c22; }
+</style>
+</head>
+<body>
+<h1>img-diff report</h1>
+<p>{{len .}} comparison(s)</p>
+{{range .}}<section>
+<h2><span class="{{.Status}}">{{.Status}}</span> {{.Ref}} {{.Cand}}</h2>
+{{range .Images}}<figure><img src="{{.Src}}" alt="{{.Title}}"><figcaption>{{.Title}}</figcaption></figure>
+{{end}}<pre>{{.Stats}}</pre>
+</section>
+{{end}}</body>
+</html>
+`))
+
+// newHTMLEntry returns the entry of the HTML report of the comparison res
+// of the ref and cand images, decoded as img1 and img2 (nil if they were
+// not kept in memory), with status st.
+// Images are downsampled as in the GUI, to keep reports small.
+func newHTMLEntry(ref, cand string, img1, img2 image.Image, res Result, st status, opts Options) (htmlEntry, error) {
+	e := htmlEntry{Ref: ref, Cand: cand, Status: st.String()}
+
+	var stats bytes.Buffer
+	report(&stats, res)
+	e.Stats = stats.String()
+
+	var hist image.Image
+	if res.Diff != nil && res.Hist != nil {
+		bnd := preview(res.Diff).Bounds()
+		hist = histDiff(res.Hist, image.Pt(bnd.Dx(), bnd.Dy()), !opts.HistLinear, histThreshold(opts), metricLabel(opts.Metric))
+	}
+	for _, v := range []struct {
+		title string
+		img   image.Image
+	}{
+		{"reference", img1},
+		{"candidate", img2},
+		{"difference", res.Diff},
+		{"histogram", hist},
+	} {
+		if v.img == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		err := png.Encode(&buf, preview(v.img))
+		if err != nil {
+			return e, fmt.Errorf("could not encode %s image: %w", v.title, err)
+		}
+		e.Images = append(e.Images, htmlImage{
+			Title: v.title,
+			Src:   template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())),
+		})
+	}
+	return e, nil
+}
+
+// newHTMLError returns the entry of the HTML report of a comparison of the
+// ref and cand images prevented by err.
+func newHTMLError(ref, cand string, err error) htmlEntry {
+	return htmlEntry{Ref: ref, Cand: cand, Status: "ERROR", Stats: err.Error()}
+}
+
+// writeHTMLReport writes to w a self-contained HTML report of entries.
+func writeHTMLReport(w io.Writer, entries []htmlEntry) error {
+	err := htmlReport.Execute(w, entries)
+	if err != nil {
+		return fmt.Errorf("could not write HTML report: %w", err)
+	}
+	return nil
+}
+
+// saveHTMLReport saves the HTML report of entries to the named file, or to
+// stdout if name is "-".
+func saveHTMLReport(name string, entries []htmlEntry) error {
+	if name == "-" {
+		return writeHTMLReport(os.Stdout, entries)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("could not create HTML report %q: %w", name, err)
+	}
+	defer f.Close()
+
+	err = writeHTMLReport(f, entries)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close HTML report %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// ignoreICC disables the conversion to sRGB of the images with an embedded
+// ICC profile.
+var ignoreICC bool
+
+// iccTolerance is the largest deviation from sRGB, in [0, 1] units, of the
+// curves and matrix of an ICC profile considered as sRGB.
+const iccTolerance = 2e-3
+
+// srgbFromD50 converts D50 XYZ values, the profile connection space of ICC
+// profiles, to linear sRGB values (Bradford-adapted to D65).
+var srgbFromD50 = [3][3]float64{
+	{+3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, +1.9161415, +0.0334540},
+	{+0.0719453, -0.2289914, +1.4052427},
+}
+
+// iccProfile is a matrix/TRC ICC profile, of an RGB or gray color space.
+type iccProfile struct {
+	desc string        // description of the profile
+	gray bool          // whether the profile describes a gray color space
+	trc  [3]iccCurve   // tone reproduction curves of the channels (only the first one for gray)
+	mat  [3][3]float64 // colorants, from linear RGB to D50 XYZ (unused for gray)
+}
+
+// iccCurve linearizes device values in [0, 1].
+type iccCurve func(x float64) float64
+
+// convertICC converts img, decoded from the PNG or JPEG image raw, to sRGB
+// when raw embeds an ICC profile, so that images encoded in different color
+// spaces are compared as they are displayed.
+//
+// Images without a profile are assumed to be sRGB, and images with a sRGB
+// profile are returned as is.
+// Only matrix/TRC profiles are handled: images with other profiles (e.g.
+// LUT-based or CMYK) are returned as is, with a warning.
+func convertICC(name string, img image.Image, raw []byte) image.Image {
+	if ignoreICC {
+		return img
+	}
+
+	var (
+		icc []byte
+		err error
+	)
+	switch {
+	case bytes.HasPrefix(raw, []byte("\xff\xd8")):
+		icc, err = jpegICC(raw)
+	case bytes.HasPrefix(raw, []byte("\x89PNG\r\n\x1a\n")):
+		icc, err = pngICC(raw)
+	}
+	if err == nil && icc == nil {
+		return img
+	}
+
+	var p *iccProfile
+	if err == nil {
+		p, err = parseICC(icc)
+	}
+	if err != nil {
+		warnf("ignoring ICC profile of image %q: %+v", name, err)
+		return img
+	}
+	if p.isSRGB() {
+		debugf("image %q has a sRGB ICC profile (%q)", name, p.desc)
+		return img
+	}
+	debugf("converting image %q from ICC profile %q to sRGB", name, p.desc)
+	return p.toSRGB(img)
+}
+
+// parseICC parses the ICC profile icc.
+func parseICC(icc []byte) (*iccProfile, error) {
+	if len(icc) < 132 || string(icc[36:40]) != "acsp" {
+		return nil, fmt.Errorf("invalid ICC profile")
+	}
+
+	var (
+		cs   = string(icc[16:20])
+		pcs  = string(icc[20:24])
+		tags = iccTags(icc)
+		p    = &iccProfile{gray: cs == "GRAY"}
+	)
+	if cs != "RGB " && cs != "GRAY" {
+		return nil, fmt.Errorf("unsupported ICC color space %q", cs)
+	}
+	if pcs != "XYZ " {
+		return nil, fmt.Errorf("unsupported ICC profile connection space %q", pcs)
+	}
+	if desc, ok := iccText(tags["desc"]); ok {
+		p.desc = desc
+	}
+
+	trcs := []string{"rTRC", "gTRC", "bTRC"}
+	if p.gray {
+		trcs = []string{"kTRC"}
+	}
+	for i, sig := range trcs {
+		v, ok := tags[sig]
+		if !ok {
+			return nil, fmt.Errorf("unsupported ICC profile: no %s tag", sig)
+		}
+		trc, err := iccParseCurve(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ICC %s tag: %w", sig, err)
+		}
+		p.trc[i] = trc
+	}
+	if p.gray {
+		return p, nil
+	}
+
+	for j, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		v, ok := tags[sig]
+		if !ok {
+			return nil, fmt.Errorf("unsupported ICC profile: no %s tag", sig)
+		}
+		if len(v) < 20 || string(v[:4]) != "XYZ " {
+			return nil, fmt.Errorf("invalid ICC %s tag", sig)
+		}
+		for i := range p.mat {
+			p.mat[i][j] = s15Fixed16(v[8+4*i:])
+		}
+	}
+	return p, nil
+}
+
+// iccTags returns the tags of the ICC profile icc, indexed by signature.
+func iccTags(icc []byte) map[string][]byte {
+	tags := make(map[string][]byte)
+	if len(icc) < 132 {
+		return tags
+	}
+	n := int(binary.BigEndian.Uint32(icc[128:]))
+	for i := 0; i < n && 132+12*(i+1) <= len(icc); i++ {
+		var (
+			e    = icc[132+12*i:]
+			off  = uint64(binary.BigEndian.Uint32(e[4:]))
+			size = uint64(binary.BigEndian.Uint32(e[8:]))
+		)
+		if off+size > uint64(len(icc)) {
+			continue
+		}
+		tags[string(e[:4])] = icc[off : off+size]
+	}
+	return tags
+}
+
+// iccParseCurve parses an ICC curveType or parametricCurveType tag.
+func iccParseCurve(p []byte) (iccCurve, error) {
+	if len(p) < 12 {
+		return nil, fmt.Errorf("invalid curve")
+	}
+	switch string(p[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(p[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, nil
+		case 12+2*n > len(p):
+			return nil, fmt.Errorf("invalid curve table")
+		case n == 1:
+			g := float64(binary.BigEndian.Uint16(p[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		}
+		tbl := make([]float64, n)
+		for i := range tbl {
+			tbl[i] = float64(binary.BigEndian.Uint16(p[12+2*i:])) / 0xffff
+		}
+		return func(x float64) float64 {
+			v := x * float64(n-1)
+			i := int(v)
+			if i >= n-1 {
+				return tbl[n-1]
+			}
+			f := v - float64(i)
+			return tbl[i]*(1-f) + tbl[i+1]*f
+		}, nil
+
+	case "para":
+		typ := int(binary.BigEndian.Uint16(p[8:]))
+		nparams := []int{1, 3, 4, 5, 7}
+		if typ >= len(nparams) || 12+4*nparams[typ] > len(p) {
+			return nil, fmt.Errorf("invalid parametric curve")
+		}
+		var v [7]float64
+		for i := 0; i < nparams[typ]; i++ {
+			v[i] = s15Fixed16(p[12+4*i:])
+		}
+		g, a, b, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+		switch typ {
+		case 0:
+			a, d = 1, 0
+		case 1:
+			d = -b / a
+		case 2:
+			d, e, f = -b/a, c, c
+			c = 0
+		}
+		return func(x float64) float64 {
+			if x >= d {
+				return math.Pow(math.Max(0, a*x+b), g) + e
+			}
+			return c*x + f
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported curve type %q", p[:4])
+	}
+}
+
+// s15Fixed16 decodes an ICC s15Fixed16Number.
+func s15Fixed16(p []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(p))) / 0x10000
+}
+
+// srgbDecode converts a sRGB value in [0, 1] to linear light.
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// srgbEncode converts a linear light value in [0, 1] to sRGB.
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// toLinearSRGB returns the matrix from the linear device values of the RGB
+// profile p to linear sRGB.
+func (p *iccProfile) toLinearSRGB() [3][3]float64 {
+	var m [3][3]float64
+	for i := range m {
+		for j := range m[i] {
+			for k := range m {
+				m[i][j] += srgbFromD50[i][k] * p.mat[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// isSRGB reports whether the profile p describes sRGB, within iccTolerance.
+func (p *iccProfile) isSRGB() bool {
+	n := 3
+	if p.gray {
+		n = 1
+	}
+	for _, trc := range p.trc[:n] {
+		for i := 0; i <= 16; i++ {
+			x := float64(i) / 16
+			if math.Abs(trc(x)-srgbDecode(x)) > iccTolerance {
+				return false
+			}
+		}
+	}
+	if p.gray {
+		return true
+	}
+	m := p.toLinearSRGB()
+	for i := range m {
+		for j := range m[i] {
+			id := 0.0
+			if i == j {
+				id = 1
+			}
+			if math.Abs(m[i][j]-id) > iccTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toSRGB converts img, encoded with the profile p, to sRGB.
+// Alpha values are kept as is.
+func (p *iccProfile) toSRGB(img image.Image) *image.NRGBA64 {
+	var (
+		lin [3][]float64 // linearized 16-bit device values
+		enc = make([]uint16, 0x10000)
+		m   = p.toLinearSRGB()
+	)
+	for i := range lin {
+		if p.gray && i > 0 {
+			lin[i] = lin[0]
+			continue
+		}
+		lin[i] = make([]float64, 0x10000)
+		for v := range lin[i] {
+			lin[i][v] = p.trc[i](float64(v) / 0xffff)
+		}
+	}
+	for v := range enc {
+		enc[v] = uint16(math.Round(srgbEncode(float64(v)/0xffff) * 0xffff))
+	}
+	encode := func(v float64) uint16 {
+		return enc[int(math.Round(math.Max(0, math.Min(1, v))*0xffff))]
+	}
+
+	var (
+		bnd = img.Bounds()
+		dst = image.NewNRGBA64(bnd)
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			var (
+				c = color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				r = lin[0][c.R]
+				g = lin[1][c.G]
+				b = lin[2][c.B]
+			)
+			if p.gray {
+				v := encode(r)
+				dst.SetNRGBA64(x, y, color.NRGBA64{v, v, v, c.A})
+				continue
+			}
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				R: encode(m[0][0]*r + m[0][1]*g + m[0][2]*b),
+				G: encode(m[1][0]*r + m[1][1]*g + m[1][2]*b),
+				B: encode(m[2][0]*r + m[2][1]*g + m[2][2]*b),
+				A: c.A,
+			})
+		}
+	}
+	return dst
+}
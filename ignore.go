@@ -0,0 +1,61 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// border is the width, in pixels, of each side of a frame around an image.
+type border struct {
+	Top, Right, Bottom, Left int
+}
+
+// parseBorder parses the widths of a border, either as a single width for
+// all sides or as 4 comma-separated widths, in the top, right, bottom, left
+// order.
+func parseBorder(s string) (border, error) {
+	var (
+		b   border
+		err error
+	)
+	switch strings.Count(s, ",") {
+	case 0:
+		_, err = fmt.Sscanf(s, "%d", &b.Top)
+		b.Right, b.Bottom, b.Left = b.Top, b.Top, b.Top
+	case 3:
+		_, err = fmt.Sscanf(s, "%d,%d,%d,%d", &b.Top, &b.Right, &b.Bottom, &b.Left)
+	default:
+		return b, fmt.Errorf("invalid border %q: expected 1 or 4 widths", s)
+	}
+	if err != nil {
+		return b, fmt.Errorf("could not parse border %q: %w", s, err)
+	}
+	if b.Top < 0 || b.Right < 0 || b.Bottom < 0 || b.Left < 0 {
+		return b, fmt.Errorf("invalid border %q: widths must be positive", s)
+	}
+	return b, nil
+}
+
+// inner returns the part of bnd inside the border b.
+func (b border) inner(bnd image.Rectangle) image.Rectangle {
+	return image.Rect(
+		bnd.Min.X+b.Left, bnd.Min.Y+b.Top,
+		bnd.Max.X-b.Right, bnd.Max.Y-b.Bottom,
+	).Intersect(bnd)
+}
+
+// ignored reports whether the color c matches the ignored color ref, each
+// of their straight (non-premultiplied) channels differing by at most tol.
+func ignored(c color.RGBA, ref color.NRGBA, tol int) bool {
+	s := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return iabs(int(s.R)-int(ref.R)) <= tol &&
+		iabs(int(s.G)-int(ref.G)) <= tol &&
+		iabs(int(s.B)-int(ref.B)) <= tol &&
+		iabs(int(s.A)-int(ref.A)) <= tol
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tiffLayer selects the page of multi-page TIFF image files that is
+// compared, by index from 0 or by name (first page if empty).
+var tiffLayer string
+
+// tiffPageName is the TIFF tag holding the name of a page.
+const tiffPageName = 285
+
+// maxTIFFPages is the maximal number of pages walked through, guarding
+// against cyclic chains of image file directories.
+const maxTIFFPages = 1 << 16
+
+// tiffPage is a page, or image file directory, of a TIFF image.
+type tiffPage struct {
+	off  uint32 // offset of the image file directory
+	name string // name of the page, if any
+}
+
+// tiffPages returns the pages of the TIFF image raw.
+func tiffPages(raw []byte) ([]tiffPage, error) {
+	if len(raw) < 8 {
+		return nil, fmt.Errorf("invalid TIFF header")
+	}
+	var bo binary.ByteOrder
+	switch string(raw[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid TIFF header")
+	}
+
+	var pages []tiffPage
+	for off := bo.Uint32(raw[4:8]); off != 0; {
+		if len(pages) >= maxTIFFPages {
+			return nil, fmt.Errorf("too many TIFF pages")
+		}
+		if uint64(off)+2 > uint64(len(raw)) {
+			return nil, fmt.Errorf("invalid TIFF IFD offset")
+		}
+		n := uint64(bo.Uint16(raw[off:]))
+		end := uint64(off) + 2 + 12*n
+		if end+4 > uint64(len(raw)) {
+			return nil, fmt.Errorf("truncated TIFF IFD")
+		}
+
+		page := tiffPage{off: off}
+		for i := uint64(0); i < n; i++ {
+			e := raw[uint64(off)+2+12*i:]
+			if bo.Uint16(e) != tiffPageName || bo.Uint16(e[2:]) != 2 { // ASCII
+				continue
+			}
+			var (
+				count = uint64(bo.Uint32(e[4:]))
+				data  = e[8:12]
+			)
+			if count > 4 {
+				p := uint64(bo.Uint32(e[8:]))
+				if p+count > uint64(len(raw)) {
+					return nil, fmt.Errorf("invalid TIFF page name")
+				}
+				data = raw[p : p+count]
+			}
+			page.name = strings.TrimRight(string(data[:count]), "\x00")
+		}
+		pages = append(pages, page)
+		off = bo.Uint32(raw[end:])
+	}
+	return pages, nil
+}
+
+// selectTIFFPage returns a copy of the TIFF image raw whose first page is
+// the page selected by layer: its index, from 0, or its name.
+// raw is returned as is if layer is empty.
+func selectTIFFPage(raw []byte, layer string) ([]byte, error) {
+	if layer == "" {
+		return raw, nil
+	}
+	pages, err := tiffPages(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	page := -1
+	if i, err := strconv.Atoi(layer); err == nil {
+		if i < 0 || i >= len(pages) {
+			return nil, fmt.Errorf("invalid page index %d (image has %d pages)", i, len(pages))
+		}
+		page = i
+	}
+	for i := 0; page < 0 && i < len(pages); i++ {
+		if pages[i].name == layer {
+			page = i
+		}
+	}
+	if page < 0 {
+		names := make([]string, len(pages))
+		for i, p := range pages {
+			names[i] = strconv.Quote(p.name)
+		}
+		return nil, fmt.Errorf("no page named %q (pages: %s)", layer, strings.Join(names, ", "))
+	}
+
+	// only the offset of the first image file directory is patched: the
+	// decoders then read the selected page as the first one.
+	dst := make([]byte, len(raw))
+	copy(dst, raw)
+	switch string(raw[:2]) {
+	case "II":
+		binary.LittleEndian.PutUint32(dst[4:8], pages[page].off)
+	default:
+		binary.BigEndian.PutUint32(dst[4:8], pages[page].off)
+	}
+	return dst, nil
+}
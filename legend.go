@@ -0,0 +1,130 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Layout of the legends added below difference images, in pixels.
+const (
+	legendHeight = 36
+	legendMargin = 8
+	legendBar    = 10
+)
+
+// legendKey is a color of a categorical legend.
+type legendKey struct {
+	C     color.RGBA
+	Label string
+}
+
+// newLegend returns a copy of img with a white strip below it, and a drawer
+// writing text onto that strip.
+func newLegend(img image.Image) (*image.RGBA, *font.Drawer) {
+	var (
+		bnd = img.Bounds()
+		dst = image.NewRGBA(image.Rect(
+			bnd.Min.X, bnd.Min.Y,
+			bnd.Max.X, bnd.Max.Y+legendHeight,
+		))
+	)
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, bnd, img, bnd.Min, draw.Src)
+
+	drw := &font.Drawer{
+		Dst:  dst,
+		Src:  image.Black,
+		Face: basicfont.Face7x13,
+	}
+	return dst, drw
+}
+
+// withLegend returns a copy of img with a color bar below it, showing the
+// colors ramp(t), for t in [0, 1], of the differences in [lo, hi].
+func withLegend(img image.Image, lo, hi float64, ramp func(t float64) color.Color) *image.RGBA {
+	dst, drw := newLegend(img)
+
+	var (
+		bnd = img.Bounds()
+		x0  = bnd.Min.X + legendMargin
+		x1  = bnd.Max.X - legendMargin
+		y0  = bnd.Max.Y + legendMargin/2
+		y1  = y0 + legendBar
+	)
+	if x1-x0 < 2 {
+		return dst
+	}
+
+	for x := x0; x < x1; x++ {
+		c := ramp(float64(x-x0) / float64(x1-x0-1))
+		for y := y0; y < y1; y++ {
+			dst.Set(x, y, c)
+		}
+	}
+	for x := x0 - 1; x <= x1; x++ {
+		dst.Set(x, y0-1, color.Black)
+		dst.Set(x, y1, color.Black)
+	}
+	for y := y0 - 1; y <= y1; y++ {
+		dst.Set(x0-1, y, color.Black)
+		dst.Set(x1, y, color.Black)
+	}
+
+	// ticks, with labels spaced by at least 60 pixels.
+	n := (x1 - x0) / 60
+	switch {
+	case n < 1:
+		n = 1
+	case n > 4:
+		n = 4
+	}
+	for i := 0; i <= n; i++ {
+		var (
+			x   = x0 + i*(x1-x0-1)/n
+			txt = fmt.Sprintf("%.3g", lo+float64(i)*(hi-lo)/float64(n))
+			w   = font.MeasureString(drw.Face, txt).Round()
+			tx  = x - w/2
+		)
+		for y := y1; y < y1+3; y++ {
+			dst.Set(x, y, color.Black)
+		}
+		if tx < bnd.Min.X {
+			tx = bnd.Min.X
+		}
+		if tx+w > bnd.Max.X {
+			tx = bnd.Max.X - w
+		}
+		drw.Dot = fixed.P(tx, y1+3+basicfont.Face7x13.Ascent)
+		drw.DrawString(txt)
+	}
+	return dst
+}
+
+// withKey returns a copy of img with a categorical legend below it.
+func withKey(img image.Image, keys []legendKey) *image.RGBA {
+	dst, drw := newLegend(img)
+
+	var (
+		bnd = img.Bounds()
+		x   = bnd.Min.X + legendMargin
+		y0  = bnd.Max.Y + (legendHeight-legendBar)/2
+	)
+	for _, k := range keys {
+		draw.Draw(dst, image.Rect(x, y0, x+legendBar, y0+legendBar), image.NewUniform(k.C), image.Point{}, draw.Src)
+		x += legendBar + 4
+		drw.Dot = fixed.P(x, y0+legendBar)
+		drw.DrawString(k.Label)
+		x = drw.Dot.X.Round() + 2*legendMargin
+	}
+	return dst
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Levels of the logged messages, by increasing severity.
+const (
+	levelDebug = iota // timings and conversion steps of the comparisons
+	levelInfo         // progress and notices
+	levelWarn         // suspicious results, not failing the comparisons
+	levelError        // failures
+)
+
+var levelNames = [...]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// Output formats of the logged messages.
+const (
+	logText = "text" // "img-diff: [level: ]message" lines
+	logJSON = "json" // one JSON object per line, with time, level and msg fields
+)
+
+// logger configures the logging of messages to stderr.
+var logger = struct {
+	level  int       // minimal level of the logged messages
+	format string    // output format of the messages
+	w      io.Writer // destination of the messages
+}{
+	level:  levelInfo,
+	format: logText,
+	w:      os.Stderr,
+}
+
+// parseLevel returns the level of the provided name.
+func parseLevel(name string) (int, error) {
+	for lvl, n := range levelNames {
+		if n == name {
+			return lvl, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// validLogFormat returns an error if name is not a valid log format.
+func validLogFormat(name string) error {
+	switch name {
+	case logText, logJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q", name)
+	}
+}
+
+// logf logs a message at the provided level, if it is not below the
+// level of the logger.
+func logf(level int, format string, args ...interface{}) {
+	if level < logger.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	switch logger.format {
+	case logJSON:
+		raw, err := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}{time.Now().UTC().Format(time.RFC3339Nano), levelNames[level], msg})
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(logger.w, "%s\n", raw)
+	default:
+		switch level {
+		case levelWarn:
+			msg = "warning: " + msg
+		case levelError:
+			msg = "error: " + msg
+		}
+		fmt.Fprintf(logger.w, "img-diff: %s\n", msg)
+	}
+}
+
+// debugf logs a message at the debug level.
+func debugf(format string, args ...interface{}) {
+	logf(levelDebug, format, args...)
+}
+
+// infof logs a message at the info level.
+func infof(format string, args ...interface{}) {
+	logf(levelInfo, format, args...)
+}
+
+// warnf logs a message at the warn level.
+func warnf(format string, args ...interface{}) {
+	logf(levelWarn, format, args...)
+}
+
+// errorf logs a message at the error level.
+func errorf(format string, args ...interface{}) {
+	logf(levelError, format, args...)
+}
+
+// fatalf logs a message at the error level, and exits with a non-zero
+// status.
+func fatalf(format string, args ...interface{}) {
+	logf(levelError, format, args...)
+	os.Exit(1)
+}
+
+// timed logs, at the debug level, the time elapsed since start by the named
+// step. It is meant to be deferred:
+//
+//	defer timed("step", time.Now())
+func timed(step string, start time.Time) {
+	debugf("%s: %v", step, time.Since(start))
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	loupeRadius = 7 // number of pixels shown on each side of the hovered pixel
+	loupeZoom   = 8 // magnification factor of the loupe
+	loupeGap    = 4 // space between the views of the loupe, in pixels
+)
+
+var (
+	loupeBackground = color.RGBA{R: 0x40, G: 0x40, B: 0x40, A: 0xff}
+	loupeOutside    = color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}
+	loupeMarker     = color.RGBA{R: 0xff, G: 0x00, B: 0xff, A: 0xff}
+)
+
+// loupe returns a nearest-neighbor magnified view of the pixels of imgs
+// around the pixel at, side by side.
+// Pixels outside of an image are displayed in gray, and the pixel at is
+// outlined.
+func loupe(imgs []image.Image, at image.Point) *image.RGBA {
+	var (
+		side = (2*loupeRadius + 1) * loupeZoom
+		dst  = image.NewRGBA(image.Rect(
+			0, 0,
+			len(imgs)*(side+loupeGap)+loupeGap,
+			side+2*loupeGap,
+		))
+	)
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(loupeBackground), image.Point{}, draw.Src)
+
+	for i, img := range imgs {
+		orig := image.Pt(loupeGap+i*(side+loupeGap), loupeGap)
+		for dy := -loupeRadius; dy <= loupeRadius; dy++ {
+			for dx := -loupeRadius; dx <= loupeRadius; dx++ {
+				var (
+					p = at.Add(image.Pt(dx, dy))
+					c = color.Color(loupeOutside)
+				)
+				if img != nil && p.In(img.Bounds()) {
+					c = img.At(p.X, p.Y)
+				}
+				min := orig.Add(image.Pt(dx+loupeRadius, dy+loupeRadius).Mul(loupeZoom))
+				r := image.Rectangle{Min: min, Max: min.Add(image.Pt(loupeZoom, loupeZoom))}
+				draw.Draw(dst, r, image.NewUniform(c), image.Point{}, draw.Src)
+			}
+		}
+
+		min := orig.Add(image.Pt(loupeRadius, loupeRadius).Mul(loupeZoom))
+		outline(dst, image.Rectangle{Min: min, Max: min.Add(image.Pt(loupeZoom, loupeZoom))}, loupeMarker)
+	}
+	return dst
+}
+
+// outline draws the 1-pixel wide border of r on dst, with color c.
+func outline(dst draw.Image, r image.Rectangle, c color.Color) {
+	for x := r.Min.X; x < r.Max.X; x++ {
+		dst.Set(x, r.Min.Y, c)
+		dst.Set(x, r.Max.Y-1, c)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		dst.Set(r.Min.X, y, c)
+		dst.Set(r.Max.X-1, y, c)
+	}
+}
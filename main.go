@@ -7,48 +7,774 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image"
+	"image/color"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"gioui.org/app"
 )
 
 func main() {
+	// messages of dependencies logged with the standard logger.
 	log.SetPrefix("img-diff: ")
 	log.SetFlags(0)
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gen":
+			runGen(os.Args[2:])
+			return
+		case "channels":
+			runChannels(os.Args[2:])
+			return
+		case "phash":
+			runPHash(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		batch = flag.Bool("batch", false, "enable batch mode")
+		verb  = flag.Bool("v", false, "log the timings and conversion steps of the comparison (same as -log-level=debug)")
+		loglv = flag.String("log-level", levelNames[levelInfo], "minimal level of the messages logged to stderr (debug, info, warn, error)")
+		logfm = flag.String("log-format", logText, "format of the messages logged to stderr (text, json: one object per line)")
 		diff  = flag.Float64("max", 0.1, "maximum allowed difference in batch mode")
+		mlvls = flag.Float64("max-levels", -1, "maximum allowed difference in batch mode, in 8-bit gray levels, instead of -max (yiq metric, disabled if negative)")
+		rept  = flag.Int("repeat", 0, "number of timed comparisons of a pair of images in batch mode, whose timing statistics are printed to stderr (disabled if zero)")
+		wrmup = flag.Int("warmup", 1, "number of untimed comparisons run before those of -repeat")
+		retry = flag.Int("retries", 0, "number of times a failing comparison is retried in batch mode, reloading both images (the best result is kept)")
+		exit0 = flag.Bool("exit-zero", false, "always exit with a zero status in batch mode (report-only)")
+		warn  = flag.Float64("warn", -1, "difference above which a warning is printed in batch mode (disabled if negative)")
+		hlin  = flag.Bool("hist-linear", false, "display the histogram with a linear Y axis")
+		hnz   = flag.Bool("hist-skip-zero", false, "exclude matching pixels from the histogram")
+		snz   = flag.Bool("stats-skip-zero", false, "exclude matching pixels from the mean and standard deviation")
+		wgts  = flag.String("weights", "", "comma-separated weights of the Y,I,Q channels (default: 0.5053,0.299,0.1957)")
+		mname = flag.String("metric", metricYIQ, "comparison metric (yiq, alpha, chebyshev, hausdorff, ncc: -max and -warn apply to 1-ncc, emd: earth mover's distance of the color histograms)")
+		mcmd  = flag.String("metric-cmd", "", "command line of an external program computing a global metric checked against -max: both images are written to its stdin as PNG, each preceded by a line with its size in bytes, and it writes the value on the first line of its stdout, optionally followed by a difference image")
+		units = flag.String("units", unitsYIQ, "units of the differences of the yiq metric and of -max and -warn (yiq, jnd, levels: 8-bit gray levels)")
+		frng  = flag.String("range", "", "comma-separated normalization range (min,max) of floating-point TIFF images (default: range of their samples)")
+		mthr  = flag.Float64("mask-threshold", 0.5, "luminance above which pixels belong to a mask (hausdorff metric)")
+		athr  = flag.Float64("alpha-threshold", 0, "alpha, in [0, 1], below which pixels of both images are considered equal")
+		igncl = flag.String("ignore-color", "", "color, as #rrggbb or #rrggbbaa, of the pixels excluded from the comparison in either image")
+		igntl = flag.Int("ignore-tolerance", 0, "maximal difference, per channel in [0, 255], of the pixels matching -ignore-color")
+		ignbd = flag.String("ignore-border", "0", "width, in pixels, of the frame around the images excluded from the comparison (N, or top,right,bottom,left)")
+		pmul  = flag.String("premultiplied", premulNone, "inputs whose color values are stored premultiplied by alpha (none, ref, cand, both)")
+		chans = flag.String("channels", channelsAll, "RGB channels compared, as any subset of rgb (others are zeroed in both images)")
+		szmis = flag.String("size-mismatch", mismatchIgnore, "handling of the pixels outside of the intersection of images of different sizes (ignore, fail: maximally different, fill: compared with -fill)")
+		fillc = flag.String("fill", "#ffffff", "color, as #rrggbb or #rrggbbaa, of the missing pixels of the smaller image with -size-mismatch=fill")
+		cmod  = flag.String("common-model", modelNone, "8-bit color model into which both images are converted before comparison (none, nrgba, gray; images are always compared as 8-bit RGBA, 16-bit inputs being quantized)")
+		algn  = flag.Int("align", 0, "maximal translation, in pixels, searched to align the images")
+		dpr   = flag.Float64("dpr", 1, "device pixel ratio by which the larger image is downscaled to match the smaller one")
+		equal = flag.Bool("equalize", false, "equalize the luminance histograms of both images before comparison")
+		blur  = flag.Float64("blur", 0, "standard deviation, in pixels, of a Gaussian smoothing of both images, to ignore dithering and compression noise (disabled if zero)")
+		aa    = flag.Bool("aa", false, "ignore differences due to antialiasing")
+		aarad = flag.Int("aa-radius", 1, "radius of the neighborhood used to detect antialiasing (larger is slower)")
+		npal  = flag.Int("palette", 0, "number of dominant colors extracted and compared (disabled if zero)")
+		bdpth = flag.Bool("bit-depth-report", false, "report differences explained by one image having a lower bit depth")
+		smpl  = flag.Float64("sample", 1, "fraction, in (0, 1], of the pixels randomly sampled for a fast approximate comparison")
+		sseed = flag.Int64("sample-seed", 1, "seed of the random sampling of pixels of -sample")
+		grid  = flag.String("grid", "", "compute the mean difference of each tile of an NxM grid (N columns, M rows)")
+		cvd   = flag.String("cvd", cvdNone, "color vision deficiency simulated to compare the images a second time, the largest difference being checked (none, protan, deutan, tritan)")
+		clsfy = flag.Bool("classify", false, "guess the type of change (shifted, recolored, added or removed content)")
+		marea = flag.Int("min-area", 0, "minimal area, in pixels, of the connected regions of differences above -max (smaller ones are ignored, disabled if zero)")
+		zonef = flag.String("max-per-region", "", "file of rectangles (x0 y0 x1 y1 max [name] per line) checked against their own maximum differences instead of -max")
+		regs  = flag.Bool("regions", false, "outline and report the connected regions of differences above -max")
+		inv   = flag.Bool("invert", false, "display matching pixels in white and differences in black")
+		heat  = flag.Bool("heatmap", false, "display differences with a color map")
+		cntrs = flag.String("contours", "", "comma-separated levels of iso-difference lines drawn over the reference image instead of the difference image (e.g. 0.1,0.3,0.5)")
+		hmin  = flag.Float64("heatmap-min", 0, "difference mapped to the first color of the heatmap")
+		hmax  = flag.Float64("heatmap-max", -1, "difference mapped to the last color of the heatmap (maximal difference if negative)")
+		lgnd  = flag.Bool("legend", false, "add a legend mapping colors to differences below the difference image")
+		sonly = flag.Bool("stats-only", false, "only compute statistics, without difference image nor histogram (batch mode: PNG images are then streamed row by row when possible)")
+		olay  = flag.String("output-layout", layoutVertical, "arrangement of the panels of the GUI and of screenshots (vertical, horizontal, grid)")
+		out   = flag.String("out", "out.png", "output file for screenshots (- for stdout)")
+		oscal = flag.Float64("screenshot-scale", 1, "scale factor of screenshots, relative to the window (e.g. 2 for crisp 2x renderings)")
+		dout  = flag.String("diff-out", "", "output file for the difference image in batch mode (- for stdout), and of the one saved with D in the GUI (default diff.png)")
+		crop  = flag.Bool("crop-to-diff", false, "crop the difference image saved with -diff-out to the differing pixels")
+		cropm = flag.Int("crop-margin", 16, "margin, in pixels, kept around the differing pixels by -crop-to-diff")
+		hout  = flag.String("hist-out-png", "", "output file for the histogram in batch mode (- for stdout)")
+		rhtml = flag.String("report-html", "", "output file for a self-contained HTML report of the comparisons in batch mode (- for stdout)")
+		flick = flag.String("flicker", "", "output file of a looping GIF animation alternating both images (- for stdout)")
+		revl  = flag.String("reveal", "", "output file of a GIF animation painting the differing pixels, largest differences first, in batch mode (- for stdout)")
+		jsono = flag.String("append-json", "", "JSON file whose array the results are appended to in batch mode (created if missing)")
+		npyo  = flag.String("npy", "", "output file for the per-pixel differences, normalized to [0, 1], as a float32 NumPy array in batch mode (- for stdout)")
+		gout  = flag.String("grid-out", "", "output file for the grid rendered as a coarse heatmap in batch mode (- for stdout)")
+		jpegq = flag.Int("jpeg-quality", 100, "quality of JPEG outputs, in [1, 100]")
+		ofmt  = flag.String("format", formatText, "output format of batch mode (text, github, prom)")
+		layer = flag.String("layer", "", "page of multi-page TIFF images compared, by index from 0 or by name (default: first page)")
+		igicc = flag.Bool("ignore-icc", false, "do not convert images with an embedded ICC profile to sRGB before comparing them")
+		rawg  = flag.String("raw", "", "layout of headerless .raw image files, as WxHxC with C channels (1: gray, 3: RGB, 4: RGBA)")
+		tmout = flag.Duration("timeout", httpClient.Timeout, "timeout for fetching remote images")
+		split = flag.String("split", splitNone, "compare the halves of a single side-by-side image (vertical: left and right, horizontal: top and bottom)")
+		swap  = flag.Bool("swap", false, "swap the reference and candidate images (S toggles it in the GUI)")
+		tiles = flag.Bool("tiles-parallel", false, "display the differences strip by strip in the GUI while they are computed, for large images")
+		loupe = flag.Bool("loupe", false, "display a magnified view of both images and their differences under the pointer (L toggles it in the GUI)")
+		anyb  = flag.Bool("any", false, "compare the first image against each of the following baselines, passing if any of them matches (implies batch mode)")
+		mfest = flag.String("manifest", "", "file listing pairs of images to compare in batch mode")
+		calib = flag.String("calibrate", "", "directory of known-good pairs of images, in its ref and cand subdirectories, whose differences are used to recommend a -max value")
+		patrn = flag.String("pattern", "", "glob pattern of the base names of the files compared in directory mode (default: all images)")
+		maxm  = flag.String("max-memory", "", "maximal memory needed to compare a pair of images, e.g. 512M or 2G (default: unlimited)")
+		updt  = flag.String("update", updateNone, "baselines overwritten by their candidates in manifest and directory modes (none, failed, all)")
+		exact = flag.Bool("exact", false, "only check that the images are identical: same bytes, or same pixels at 16 bits per channel")
+		exctb = flag.Bool("exact-bytes", false, "only check that the image files have the same bytes")
+		meta  = flag.Bool("metadata", false, "compare the EXIF and ICC metadata of the images instead of their pixels")
+		ffast = flag.Bool("fail-fast", false, "stop at the first failing pair in manifest and directory modes, skipping the other ones")
+		sumry = flag.Bool("summary-only", false, "only print the overall status and the failing pairs in manifest and directory modes")
+		prog  = flag.Bool("progress", false, "print the progress of manifest and directory comparisons to stderr")
+		cfg   = flag.String("config", "", "JSON file providing default values of flags")
 	)
 	flag.Parse()
 
-	if flag.NArg() < 2 {
-		flag.Usage()
-		log.Fatalf("missing input image(s)")
+	cli := setFlags(flag.CommandLine) // flags set on the command line, before -config
+	if *cfg != "" {
+		err := applyConfig(flag.CommandLine, *cfg)
+		if err != nil {
+			fatalf("could not apply config: %+v", err)
+		}
 	}
 
-	img1, err := loadImage(flag.Arg(0))
+	err := validLogFormat(*logfm)
 	if err != nil {
-		log.Fatalf("could not load image %q: %+v", flag.Arg(0), err)
+		fatalf("invalid -log-format value: %+v", err)
 	}
-	img2, err := loadImage(flag.Arg(1))
+	logger.format = *logfm
+	logger.level, err = parseLevel(*loglv)
 	if err != nil {
-		log.Fatalf("could not load image %q: %+v", flag.Arg(1), err)
+		fatalf("invalid -log-level value: %+v", err)
+	}
+	if *verb {
+		logger.level = levelDebug
 	}
 
-	gui := NewUI(img1, img2)
-	if *batch {
-		fmt.Printf("diff=[%g, %g]\n", gui.dmin, gui.dmax)
+	err = validMetric(*mname)
+	if err != nil {
+		fatalf("invalid -metric value: %+v", err)
+	}
+	if *mcmd != "" && (*mname == metricHausdorff || *mname == metricNCC || *mname == metricEMD) {
+		fatalf("-metric-cmd can not be used with the global metric %q", *mname)
+	}
+
+	err = validUnits(*units)
+	if err != nil {
+		fatalf("invalid -units value: %+v", err)
+	}
+	if (*units == unitsJND || *units == unitsLevels) && *mname != metricYIQ {
+		fatalf("-units %s requires -metric yiq", *units)
+	}
+
+	err = validFormat(*ofmt)
+	if err != nil {
+		fatalf("invalid -format value: %+v", err)
+	}
+
+	if *jpegq < 1 || *jpegq > 100 {
+		fatalf("invalid -jpeg-quality value %d: must be in [1, 100]", *jpegq)
+	}
+
+	if *athr < 0 || *athr > 1 {
+		fatalf("invalid -alpha-threshold value %g: must be in [0, 1]", *athr)
+	}
+
+	err = validPremultiplied(*pmul)
+	if err != nil {
+		fatalf("invalid -premultiplied value: %+v", err)
+	}
+
+	err = validModel(*cmod)
+	if err != nil {
+		fatalf("invalid -common-model value: %+v", err)
+	}
+	if *cmod != modelNone && *pmul != premulNone {
+		fatalf("-common-model can not be used with -premultiplied")
+	}
+
+	err = validLayout(*olay)
+	if err != nil {
+		fatalf("invalid -output-layout value: %+v", err)
+	}
+
+	err = validSizeMismatch(*szmis)
+	if err != nil {
+		fatalf("invalid -size-mismatch value: %+v", err)
+	}
+	fill, err := parseColor(*fillc)
+	if err != nil {
+		fatalf("invalid -fill value: %+v", err)
+	}
+
+	if *smpl <= 0 || *smpl > 1 {
+		fatalf("invalid -sample value %g (must be in (0, 1])", *smpl)
+	}
+
+	err = validCVD(*cvd)
+	if err != nil {
+		fatalf("invalid -cvd value: %+v", err)
+	}
+
+	err = validSplit(*split)
+	if err != nil {
+		fatalf("invalid -split value: %+v", err)
+	}
+
+	err = validChannels(*chans)
+	if err != nil {
+		fatalf("invalid -channels value: %+v", err)
+	}
+
+	err = validUpdate(*updt)
+	if err != nil {
+		fatalf("invalid -update value: %+v", err)
+	}
+
+	if _, err := filepath.Match(*patrn, ""); err != nil {
+		fatalf("invalid -pattern value %q: %+v", *patrn, err)
+	}
+
+	if *dpr <= 0 {
+		fatalf("invalid -dpr value %g: must be positive", *dpr)
+	}
+
+	if *blur < 0 {
+		fatalf("invalid -blur value %g: must be positive or zero", *blur)
+	}
+
+	if *aarad < 1 {
+		fatalf("invalid -aa-radius value %d: must be at least 1", *aarad)
+	}
+
+	if *npal < 0 {
+		fatalf("invalid -palette value %d: must be positive or zero", *npal)
+	}
+
+	var maxMem int64
+	if *maxm != "" {
+		maxMem, err = parseSize(*maxm)
+		if err != nil {
+			fatalf("invalid -max-memory value: %+v", err)
+		}
+	}
+
+	weights, err := parseWeights(*wgts)
+	if err != nil {
+		fatalf("invalid -weights value %q: %+v", *wgts, err)
+	}
+
+	frange, err := parseRange(*frng)
+	if err != nil {
+		fatalf("invalid -range value %q: %+v", *frng, err)
+	}
+
+	httpClient.Timeout = *tmout
+
+	tiffLayer = *layer
+	ignoreICC = *igicc
+
+	if *rawg != "" {
+		rawGeom, err = parseRawGeometry(*rawg)
+		if err != nil {
+			fatalf("invalid -raw value: %+v", err)
+		}
+	}
+
+	ignoreBorder, err := parseBorder(*ignbd)
+	if err != nil {
+		fatalf("invalid -ignore-border value: %+v", err)
+	}
+
+	contours, err := parseLevels(*cntrs)
+	if err != nil {
+		fatalf("invalid -contours value: %+v", err)
+	}
+
+	var zones []zone
+	if *zonef != "" {
+		zones, err = readZones(*zonef)
+		if err != nil {
+			fatalf("invalid -max-per-region value: %+v", err)
+		}
+	}
+
+	var ignore *color.NRGBA
+	if *igncl != "" {
+		c, err := parseColor(*igncl)
+		if err != nil {
+			fatalf("invalid -ignore-color value: %+v", err)
+		}
+		ignore = &c
+	}
+	if *igntl < 0 || *igntl > 0xff {
+		fatalf("invalid -ignore-tolerance value %d (must be in [0, 255])", *igntl)
+	}
+
+	var gridSize image.Point
+	if *grid != "" {
+		gridSize, err = parseGrid(*grid)
+		if err != nil {
+			fatalf("invalid -grid value: %+v", err)
+		}
+	}
+
+	opts := Options{
+		Max:             *diff,
+		Warn:            *warn,
+		Format:          *ofmt,
+		HistLinear:      *hlin,
+		HistSkipZero:    *hnz,
+		SkipZero:        *snz,
+		Weights:         weights,
+		Metric:          *mname,
+		MetricCmd:       *mcmd,
+		MaskThreshold:   *mthr,
+		Range:           frange,
+		Units:           *units,
+		Align:           *algn,
+		DPR:             *dpr,
+		Blur:            *blur,
+		Equalize:        *equal,
+		AntiAliasing:    *aa,
+		AARadius:        *aarad,
+		Palette:         *npal,
+		BitDepth:        *bdpth,
+		Regions:         *regs,
+		Classify:        *clsfy,
+		MinArea:         *marea,
+		Zones:           zones,
+		CVD:             *cvd,
+		Sample:          *smpl,
+		SampleSeed:      *sseed,
+		Grid:            gridSize,
+		Invert:          *inv,
+		Legend:          *lgnd,
+		StatsOnly:       *sonly,
+		Heatmap:         *heat,
+		Contours:        contours,
+		HeatMin:         *hmin,
+		HeatMax:         *hmax,
+		AlphaThreshold:  *athr,
+		IgnoreColor:     ignore,
+		IgnoreTolerance: *igntl,
+		IgnoreBorder:    ignoreBorder,
+		Premultiplied:   *pmul,
+		CommonModel:     *cmod,
+		Channels:        *chans,
+		SizeMismatch:    *szmis,
+		Fill:            fill,
+		Output:          *out,
+		OutputScale:     *oscal,
+		OutputLayout:    *olay,
+		DiffOut:         *dout,
+		HistOut:         *hout,
+		GridOut:         *gout,
+		HTMLOut:         *rhtml,
+		NPYOut:          *npyo,
+		JSONOut:         *jsono,
+		CropToDiff:      *crop,
+		CropMargin:      *cropm,
+		JPEGQuality:     *jpegq,
+		Progress:        *prog,
+		SummaryOnly:     *sumry,
+		FailFast:        *ffast,
+		MaxMemory:       maxMem,
+		Update:          *updt,
+		Retries:         *retry,
+	}
+
+	if *mlvls >= 0 {
+		levels, err := useMaxLevels(cli, setFlags(flag.CommandLine))
+		if err != nil {
+			fatalf("%+v", err)
+		}
+		if !levels {
+			*mlvls = -1
+		}
+	}
+	if *mlvls >= 0 {
+		if opts.Metric != metricYIQ {
+			fatalf("-max-levels requires -metric yiq")
+		}
+		// grays differing by exactly -max-levels levels pass, despite
+		// the rounding errors of the YIQ conversion.
+		opts.Max = toUnits(opts)(fromLevels(*mlvls+levelPrecision, yiqLevel(opts)))
+		debugf("maximum allowed difference of %g levels: %g", *mlvls, opts.Max)
+	}
+	if opts.StatsOnly && (opts.DiffOut != "" || opts.HistOut != "" || opts.NPYOut != "" || *revl != "") {
+		fatalf("-stats-only can not be used with -diff-out, -hist-out-png, -npy nor -reveal")
+	}
+	if !(opts.OutputScale > 0) {
+		fatalf("invalid -screenshot-scale value %g (must be positive)", opts.OutputScale)
+	}
+	if *rept < 0 || *wrmup < 0 {
+		fatalf("invalid -repeat or -warmup value (must be positive)")
+	}
+	if opts.Retries < 0 {
+		fatalf("invalid -retries value %d (must be positive)", opts.Retries)
+	}
+	if opts.MinArea < 0 {
+		fatalf("invalid -min-area value %d (must be positive)", opts.MinArea)
+	}
+	if opts.CropMargin < 0 {
+		fatalf("invalid -crop-margin value %d (must be positive)", opts.CropMargin)
+	}
+	if opts.CropToDiff && opts.Legend {
+		fatalf("-crop-to-diff can not be used with -legend")
+	}
+	if opts.GridOut != "" && opts.Grid == (image.Point{}) {
+		fatalf("-grid-out requires -grid")
+	}
+	if n := countStdout(opts.DiffOut, opts.HistOut, opts.GridOut, opts.HTMLOut, opts.NPYOut, *flick, *revl); n > 1 {
+		fatalf("only one of -diff-out, -hist-out-png, -grid-out, -report-html, -npy, -flicker and -reveal can be written to stdout")
+	}
+	if opts.StatsOnly && opts.Regions {
+		fatalf("-stats-only can not be used with -regions")
+	}
+
+	if *calib != "" {
+		err := calibrate(os.Stdout, *calib, *patrn, opts)
+		if err != nil {
+			fatalf("could not calibrate: %+v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *mfest != "" || (flag.NArg() == 2 && isDir(flag.Arg(0)) && isDir(flag.Arg(1))) {
+		if opts.DiffOut != "" || opts.HistOut != "" || opts.GridOut != "" || opts.NPYOut != "" || *flick != "" || *revl != "" {
+			fatalf("-diff-out, -hist-out-png, -grid-out, -npy, -flicker and -reveal can not be used with -manifest nor directories")
+		}
+		if opts.HTMLOut == "-" {
+			fatalf("-report-html can not be written to stdout with -manifest nor directories")
+		}
+		if *rept > 0 {
+			fatalf("-repeat can not be used with -manifest nor directories")
+		}
+		var pairs []pair
 		switch {
-		case gui.dmax > *diff:
+		case *mfest != "":
+			pairs, err = readManifest(*mfest, opts.Max)
+			if err != nil {
+				fatalf("could not read manifest: %+v", err)
+			}
+		default:
+			pairs, err = dirPairs(flag.Arg(0), flag.Arg(1), *patrn, opts.Max)
+			if err != nil {
+				fatalf("could not list directories: %+v", err)
+			}
+		}
+		if !runPairs(pairs, opts) && !*exit0 {
 			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Update != updateNone {
+		fatalf("-update requires -manifest or directories")
+	}
+
+	if *exact || *exctb {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			fatalf("-exact and -exact-bytes require 2 input images")
+		}
+		ok, err := exactMatch(os.Stdout, flag.Arg(0), flag.Arg(1), *exctb, opts)
+		if err != nil {
+			fatalf("could not compare images: %+v", err)
+		}
+		if !ok && !*exit0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *meta {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			fatalf("-metadata requires 2 input images")
+		}
+		n, err := compareMetadata(os.Stdout, flag.Arg(0), flag.Arg(1))
+		if err != nil {
+			fatalf("could not compare metadata: %+v", err)
+		}
+		if n > 0 && !*exit0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var (
+		ref, cand  = flag.Arg(0), flag.Arg(1)
+		img1, img2 image.Image
+		stream     bool
+	)
+	switch {
+	case *split != splitNone:
+		if flag.NArg() != 1 {
+			flag.Usage()
+			fatalf("-split requires a single input image")
+		}
+		if opts.Retries > 0 {
+			fatalf("-split can not be used with -retries")
+		}
+		if *anyb {
+			fatalf("-split can not be used with -any")
+		}
+		err = checkMemory(ref, ref, opts.MaxMemory)
+		if err != nil {
+			fatalf("%+v", err)
+		}
+		img, err := loadImage(ref)
+		if err != nil {
+			fatalf("could not load image %q: %+v", ref, err)
+		}
+		img1, img2 = splitImage(img, *split)
+		ref, cand = splitNames(ref, *split)
+
+	case *anyb:
+		if flag.NArg() < 2 {
+			flag.Usage()
+			fatalf("-any requires a candidate and at least one baseline")
+		}
+		// baselines are loaded one at a time, while comparing them.
+		if *flick != "" || *revl != "" {
+			fatalf("-flicker and -reveal can not be used with -any")
+		}
+		ref, cand = flag.Arg(1), flag.Arg(0)
+		*batch = true
+
+	case *batch && *flick == "" && opts.Retries == 0 && *rept == 0 && canStream(ref, cand, opts):
+		// both images are decoded row by row while comparing them.
+		debugf("streaming comparison of %q and %q", ref, cand)
+		stream = true
+
+	default:
+		if flag.NArg() < 2 {
+			flag.Usage()
+			fatalf("missing input image(s)")
+		}
+
+		err = checkMemory(ref, cand, opts.MaxMemory)
+		if err != nil {
+			fatalf("%+v", err)
+		}
+
+		img1, err = loadImage(ref)
+		if err != nil {
+			fatalf("could not load image %q: %+v", ref, err)
+		}
+		img2, err = loadCandidate(cand, img1)
+		if err != nil {
+			fatalf("could not load image %q: %+v", cand, err)
+		}
+	}
+
+	if *swap {
+		if *anyb {
+			fatalf("-swap can not be used with -any")
+		}
+		ref, cand = cand, ref
+		img1, img2 = img2, img1
+	}
+
+	if *flick != "" {
+		err = saveFlicker(*flick, img1, img2)
+		if err != nil {
+			fatalf("could not save flicker animation: %+v", err)
+		}
+	}
+
+	if !*batch && !hasDisplay() {
+		infof("no display available (DISPLAY and WAYLAND_DISPLAY are unset), falling back to batch mode")
+		*batch = true
+	}
+
+	if *batch && !*anyb && flag.NArg() > 2 {
+		fatalf("batch mode compares a single pair of images (got %d candidates)", flag.NArg()-1)
+	}
+
+	if *rept > 0 {
+		if !*batch || *anyb {
+			fatalf("-repeat requires batch mode, and can not be used with -any")
+		}
+		benchDiff(os.Stderr, img1, img2, *wrmup, *rept, opts)
+	}
+
+	if *batch {
+		var res Result
+		switch {
+		case *anyb:
+			var i int
+			i, res, err = anyDiff(cand, flag.Args()[1:], opts.Max, opts)
+			ref = flag.Arg(i + 1)
+		case stream:
+			res, err = streamDiff(ref, cand, opts)
 		default:
-			os.Exit(0)
+			p := pair{ref: ref, cand: cand, max: opts.Max}
+			res, err = retryDiff(p, img1, img2, opts)
+		}
+		if err != nil {
+			fatalf("could not compare images: %+v", err)
+		}
+		err = saveOutputs(res, opts)
+		if err != nil {
+			fatalf("could not save outputs: %+v", err)
+		}
+		if *revl != "" {
+			err = saveReveal(*revl, img1, res.Values)
+			if err != nil {
+				fatalf("could not save reveal animation: %+v", err)
+			}
+		}
+		// keep stdout for the image written to it, if any.
+		var w io.Writer = os.Stdout
+		if countStdout(opts.DiffOut, opts.HistOut, opts.GridOut, opts.HTMLOut, opts.NPYOut, *flick, *revl) > 0 {
+			w = os.Stderr
+		}
+		st := check(res, opts.Max, opts.Warn)
+		if opts.HTMLOut != "" {
+			e, err := newHTMLEntry(ref, cand, img1, img2, res, st, opts)
+			if err == nil {
+				err = saveHTMLReport(opts.HTMLOut, []htmlEntry{e})
+			}
+			if err != nil {
+				fatalf("could not save HTML report: %+v", err)
+			}
 		}
+		if opts.JSONOut != "" {
+			err = appendJSON(opts.JSONOut, []jsonRecord{newJSONRecord(ref, cand, res, st)})
+			if err != nil {
+				fatalf("could not save JSON summary: %+v", err)
+			}
+		}
+		if *anyb && opts.Format != formatProm {
+			match := "matched"
+			if st == statusFail {
+				match = "closest"
+			}
+			fmt.Fprintf(w, "baseline=%s (%s)\n", ref, match)
+		}
+		switch opts.Format {
+		case formatProm:
+			writeProm(w, []sample{{ref: ref, cand: cand, res: res}})
+		case formatGitHub:
+			report(w, res)
+			annotate(w, st, ref, cand, res, opts.Max, opts.Warn)
+		default:
+			report(w, res)
+		}
+		switch st {
+		case statusFail:
+			errorf("%s", failure(res, opts.Max))
+			if !*exit0 {
+				os.Exit(1)
+			}
+		case statusWarn:
+			warnf("difference %g exceeds warning threshold %g", res.Value(), opts.Warn)
+		}
+		os.Exit(0)
+	}
+
+	if opts.StatsOnly {
+		fatalf("-stats-only requires batch mode")
 	}
 
+	gui := NewUI(img1, img2, opts)
+
+	gui.cands = flag.Args()[1:]
+	gui.swapped = *swap
+	gui.loupe = *loupe
+	gui.tiles = *tiles
 	go gui.run()
 
 	app.Main()
 }
+
+// parseRange parses a comma-separated normalization range "min,max".
+// An empty string yields a nil range.
+func parseRange(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	toks := strings.Split(s, ",")
+	if len(toks) != 2 {
+		return nil, fmt.Errorf("expected 2 values, got %d", len(toks))
+	}
+
+	rng := make([]float64, len(toks))
+	for i, tok := range toks {
+		v, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse range value %q: %w", tok, err)
+		}
+		rng[i] = v
+	}
+	if !(rng[0] < rng[1]) {
+		return nil, fmt.Errorf("empty range [%g, %g]", rng[0], rng[1])
+	}
+	return rng, nil
+}
+
+// countStdout returns the number of outputs written to stdout.
+func countStdout(outputs ...string) int {
+	n := 0
+	for _, name := range outputs {
+		if name == "-" {
+			n++
+		}
+	}
+	return n
+}
+
+// isDir reports whether name is an existing directory.
+func isDir(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+// hasDisplay reports whether a display server is available to open a window.
+func hasDisplay() bool {
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd":
+		return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	default:
+		return true
+	}
+}
+
+// parseWeights parses a comma-separated list of Y,I,Q channel weights.
+// An empty string selects the default weights.
+func parseWeights(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	toks := strings.Split(s, ",")
+	if len(toks) != 3 {
+		return nil, fmt.Errorf("expected 3 weights, got %d", len(toks))
+	}
+
+	var (
+		ws  = make([]float64, len(toks))
+		sum = 0.0
+	)
+	for i, tok := range toks {
+		v, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse weight %q: %w", tok, err)
+		}
+		if v < 0 {
+			return nil, fmt.Errorf("weight %q is negative", tok)
+		}
+		ws[i] = v
+		sum += v
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("at least one weight must be positive")
+	}
+
+	return ws, nil
+}
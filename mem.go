@@ -0,0 +1,125 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a memory size such as "512M" or "2GiB".
+// Suffixes are powers of 1024.
+func parseSize(s string) (int64, error) {
+	var (
+		str  = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+		unit = int64(1)
+	)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			str = str[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse size %q: %w", s, err)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("size %q is negative", s)
+	}
+	return v * unit, nil
+}
+
+// imageDims returns the dimensions of the named image file, read from its
+// header without decoding the image.
+// ok is false if the dimensions can not be known before loading the image,
+// as for remote images.
+func imageDims(name string) (dims image.Point, ok bool, err error) {
+	switch {
+	case isURL(name):
+		return dims, false, nil
+	case strings.EqualFold(filepath.Ext(name), ".raw"):
+		return image.Pt(rawGeom.W, rawGeom.H), rawGeom.C != 0, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return dims, false, fmt.Errorf("could not open image file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil && isTIFF(name) {
+		// floating-point TIFF images are not handled by the tiff package.
+		raw, rerr := ioutil.ReadFile(name)
+		if rerr != nil {
+			return dims, false, fmt.Errorf("could not read image file %q: %w", name, rerr)
+		}
+		if dims, ok, ferr := floatTIFFDims(raw); ferr == nil && ok {
+			return dims, true, nil
+		}
+	}
+	if err != nil {
+		return dims, false, fmt.Errorf("could not decode header of image file %q: %w", name, err)
+	}
+	return image.Pt(cfg.Width, cfg.Height), true, nil
+}
+
+// memEstimate returns an estimate of the memory, in bytes, needed to compare
+// images of dimensions d1 and d2: both images as RGBA, and the 16-bit
+// difference image.
+func memEstimate(d1, d2 image.Point) int64 {
+	var (
+		a1 = int64(d1.X) * int64(d1.Y)
+		a2 = int64(d2.X) * int64(d2.Y)
+		ad = int64(imax(d1.X, d2.X)) * int64(imax(d1.Y, d2.Y))
+	)
+	return 4*(a1+a2) + 2*ad
+}
+
+// checkMemory returns an error if the comparison of the named reference
+// and candidate images would need more than limit bytes.
+// A zero limit disables the check, as do remote images.
+func checkMemory(ref, cand string, limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	d1, ok, err := imageDims(ref)
+	if err != nil || !ok {
+		return err
+	}
+	d2 := d1
+	if !strings.HasPrefix(cand, "color:") {
+		d2, ok, err = imageDims(cand)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	if n := memEstimate(d1, d2); n > limit {
+		return fmt.Errorf(
+			"comparing %q (%dx%d) and %q (%dx%d) needs about %.1f MiB, more than the %.1f MiB limit",
+			ref, d1.X, d1.Y, cand, d2.X, d2.Y,
+			float64(n)/(1<<20), float64(limit)/(1<<20),
+		)
+	}
+	return nil
+}
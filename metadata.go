@@ -0,0 +1,456 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// exifTags names the EXIF tags compared in metadata mode.
+var exifTags = map[uint16]string{
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x8298: "Copyright",
+	0x9000: "ExifVersion",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9010: "OffsetTime",
+	0xa001: "ColorSpace",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+}
+
+// Pointers to the sub-directories of the EXIF IFD0.
+const (
+	exifIFDPointer = 0x8769
+	exifGPSPointer = 0x8825
+)
+
+// readMetadata returns the metadata of the named JPEG or PNG image file:
+// its main EXIF tags, the header and description of its ICC profile, and
+// its PNG ancillary chunks, indexed by field name.
+// Other formats have no metadata.
+func readMetadata(name string) (map[string]string, error) {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image file %q: %w", name, err)
+	}
+
+	meta := make(map[string]string)
+	switch {
+	case bytes.HasPrefix(raw, []byte("\xff\xd8")):
+		err = jpegMetadata(raw, meta)
+	case bytes.HasPrefix(raw, []byte("\x89PNG\r\n\x1a\n")):
+		err = pngMetadata(raw, meta)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read metadata of image file %q: %w", name, err)
+	}
+	return meta, nil
+}
+
+// jpegMetadata adds to meta the metadata of the APP1 (EXIF) and APP2 (ICC)
+// segments of the JPEG image raw.
+func jpegMetadata(raw []byte, meta map[string]string) error {
+	err := jpegSegments(raw, func(marker byte, seg []byte) error {
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifMetadata(seg[6:], meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	icc, err := jpegICC(raw)
+	if err != nil {
+		return err
+	}
+	if icc != nil {
+		iccMetadata(icc, meta)
+	}
+	return nil
+}
+
+// jpegSegments calls fn with the marker and the payload of each segment of
+// the JPEG image raw, up to its first scan.
+func jpegSegments(raw []byte, fn func(marker byte, seg []byte) error) error {
+	for p := raw[2:]; len(p) >= 4; {
+		if p[0] != 0xff {
+			return fmt.Errorf("invalid JPEG marker")
+		}
+		marker := p[1]
+		if marker == 0xd8 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			p = p[2:]
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			// start of scan: no more metadata.
+			break
+		}
+		size := int(binary.BigEndian.Uint16(p[2:]))
+		if size < 2 || 2+size > len(p) {
+			return fmt.Errorf("invalid JPEG segment 0x%02x", marker)
+		}
+		seg := p[4 : 2+size]
+		p = p[2+size:]
+
+		err := fn(marker, seg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jpegICC returns the ICC profile embedded in the APP2 segments of the
+// JPEG image raw, or nil if there is none.
+func jpegICC(raw []byte) ([]byte, error) {
+	var icc [][]byte
+	err := jpegSegments(raw, func(marker byte, seg []byte) error {
+		if marker == 0xe2 && bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00")) && len(seg) >= 14 {
+			// chunks are numbered from 1.
+			i := int(seg[12]) - 1
+			for len(icc) <= i {
+				icc = append(icc, nil)
+			}
+			if i >= 0 {
+				icc[i] = seg[14:]
+			}
+		}
+		return nil
+	})
+	if err != nil || icc == nil {
+		return nil, err
+	}
+	return bytes.Join(icc, nil), nil
+}
+
+// pngMetadata adds to meta the metadata of the ancillary chunks of the PNG
+// image raw.
+func pngMetadata(raw []byte, meta map[string]string) error {
+	return pngChunks(raw, func(typ string, data []byte) error {
+		switch typ {
+		case "eXIf":
+			return exifMetadata(data, meta)
+		case "iCCP":
+			name, icc, err := decodeICCP(data)
+			if err != nil {
+				return err
+			}
+			meta["png.iCCP"] = name
+			iccMetadata(icc, meta)
+		case "sRGB":
+			meta["png.sRGB"] = fmt.Sprint(data)
+		case "gAMA":
+			if len(data) == 4 {
+				meta["png.gAMA"] = fmt.Sprintf("%g", float64(binary.BigEndian.Uint32(data))/100000)
+			}
+		case "pHYs":
+			if len(data) == 9 {
+				meta["png.pHYs"] = fmt.Sprintf(
+					"%dx%d (unit=%d)",
+					binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:]), data[8],
+				)
+			}
+		case "tIME":
+			if len(data) == 7 {
+				meta["png.tIME"] = fmt.Sprintf(
+					"%04d-%02d-%02dT%02d:%02d:%02d",
+					binary.BigEndian.Uint16(data), data[2], data[3], data[4], data[5], data[6],
+				)
+			}
+		case "tEXt":
+			if i := bytes.IndexByte(data, 0); i >= 0 {
+				meta["png.tEXt."+string(data[:i])] = string(data[i+1:])
+			}
+		}
+		return nil
+	})
+}
+
+// pngChunks calls fn with the type and the data of each chunk of the PNG
+// image raw, up to its IEND chunk.
+func pngChunks(raw []byte, fn func(typ string, data []byte) error) error {
+	for p := raw[8:]; len(p) >= 12; {
+		size := int(binary.BigEndian.Uint32(p))
+		if size < 0 || 12+size > len(p) {
+			return fmt.Errorf("invalid PNG chunk")
+		}
+		var (
+			typ  = string(p[4:8])
+			data = p[8 : 8+size]
+		)
+		p = p[12+size:]
+
+		if typ == "IEND" {
+			return nil
+		}
+		err := fn(typ, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pngICC returns the ICC profile embedded in the iCCP chunk of the PNG
+// image raw, or nil if there is none.
+func pngICC(raw []byte) ([]byte, error) {
+	var icc []byte
+	err := pngChunks(raw, func(typ string, data []byte) error {
+		if typ != "iCCP" {
+			return nil
+		}
+		var err error
+		_, icc, err = decodeICCP(data)
+		return err
+	})
+	return icc, err
+}
+
+// decodeICCP returns the name and the decompressed ICC profile of the
+// data of a PNG iCCP chunk.
+func decodeICCP(data []byte) (string, []byte, error) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+2 > len(data) {
+		return "", nil, fmt.Errorf("invalid PNG iCCP chunk")
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+	if err != nil {
+		return "", nil, fmt.Errorf("could not decompress ICC profile: %w", err)
+	}
+	icc, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not decompress ICC profile: %w", err)
+	}
+	return string(data[:i]), icc, nil
+}
+
+// exifMetadata adds to meta the tags of exifTags found in the IFD0 and the
+// EXIF sub-IFD of the TIFF-structured EXIF data raw.
+func exifMetadata(raw []byte, meta map[string]string) error {
+	if len(raw) < 8 {
+		return fmt.Errorf("invalid EXIF header")
+	}
+	var bo binary.ByteOrder
+	switch string(raw[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return fmt.Errorf("invalid EXIF header")
+	}
+
+	var walk func(off uint32, depth int) error
+	walk = func(off uint32, depth int) error {
+		if uint64(off)+2 > uint64(len(raw)) {
+			return fmt.Errorf("invalid EXIF IFD offset")
+		}
+		n := int(bo.Uint16(raw[off:]))
+		if int(off)+2+12*n > len(raw) {
+			return fmt.Errorf("truncated EXIF IFD")
+		}
+		for i := 0; i < n; i++ {
+			var (
+				e     = raw[int(off)+2+12*i:]
+				tag   = bo.Uint16(e)
+				typ   = bo.Uint16(e[2:])
+				count = bo.Uint32(e[4:])
+			)
+			switch tag {
+			case exifIFDPointer:
+				if depth == 0 {
+					err := walk(bo.Uint32(e[8:]), depth+1)
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			case exifGPSPointer:
+				meta["exif.GPS"] = "present"
+				continue
+			}
+			name, ok := exifTags[tag]
+			if !ok {
+				continue
+			}
+			v, ok := exifValue(raw, bo, typ, count, e[8:12])
+			if ok {
+				meta["exif."+name] = v
+			}
+		}
+		return nil
+	}
+	return walk(bo.Uint32(raw[4:]), 0)
+}
+
+// exifValue formats the value of an EXIF entry of type typ, holding count
+// values stored in (or pointed to by) field.
+func exifValue(raw []byte, bo binary.ByteOrder, typ uint16, count uint32, field []byte) (string, bool) {
+	var size uint32
+	switch typ {
+	case 1, 2, 7: // BYTE, ASCII, UNDEFINED
+		size = 1
+	case 3: // SHORT
+		size = 2
+	case 4, 9: // LONG, SLONG
+		size = 4
+	case 5, 10: // RATIONAL, SRATIONAL
+		size = 8
+	default:
+		return "", false
+	}
+
+	data := field
+	if n := uint64(count) * uint64(size); n > 4 {
+		off := uint64(bo.Uint32(field))
+		if off+n > uint64(len(raw)) {
+			return "", false
+		}
+		data = raw[off : off+n]
+	}
+	data = data[:count*size]
+
+	if typ == 2 || typ == 7 {
+		return strings.TrimRight(string(data), "\x00 "), true
+	}
+	vs := make([]string, count)
+	for i := range vs {
+		p := data[uint32(i)*size:]
+		switch typ {
+		case 1:
+			vs[i] = fmt.Sprint(p[0])
+		case 3:
+			vs[i] = fmt.Sprint(bo.Uint16(p))
+		case 4:
+			vs[i] = fmt.Sprint(bo.Uint32(p))
+		case 9:
+			vs[i] = fmt.Sprint(int32(bo.Uint32(p)))
+		case 5:
+			vs[i] = fmt.Sprintf("%d/%d", bo.Uint32(p), bo.Uint32(p[4:]))
+		case 10:
+			vs[i] = fmt.Sprintf("%d/%d", int32(bo.Uint32(p)), int32(bo.Uint32(p[4:])))
+		}
+	}
+	return strings.Join(vs, ","), true
+}
+
+// iccMetadata adds to meta the main header fields and the description of
+// the ICC profile icc.
+func iccMetadata(icc []byte, meta map[string]string) {
+	meta["icc.checksum"] = fmt.Sprintf("%08x", crc32.ChecksumIEEE(icc))
+	if len(icc) < 132 {
+		return
+	}
+	sig := func(p []byte) string {
+		return strings.TrimSpace(string(p[:4]))
+	}
+	meta["icc.version"] = fmt.Sprintf("%d.%d", icc[8], icc[9]>>4)
+	meta["icc.class"] = sig(icc[12:])
+	meta["icc.colorspace"] = sig(icc[16:])
+	meta["icc.pcs"] = sig(icc[20:])
+	meta["icc.intent"] = fmt.Sprint(binary.BigEndian.Uint32(icc[64:]))
+
+	if desc, ok := iccText(iccTags(icc)["desc"]); ok {
+		meta["icc.description"] = desc
+	}
+}
+
+// iccText decodes the text of an ICC textDescriptionType (v2) or
+// multiLocalizedUnicodeType (v4) tag, using its first record for the
+// latter.
+func iccText(p []byte) (string, bool) {
+	if len(p) < 12 {
+		return "", false
+	}
+	switch string(p[:4]) {
+	case "desc":
+		n := uint64(binary.BigEndian.Uint32(p[8:]))
+		if 12+n > uint64(len(p)) {
+			return "", false
+		}
+		return strings.TrimRight(string(p[12:12+n]), "\x00"), true
+	case "mluc":
+		if len(p) < 28 || binary.BigEndian.Uint32(p[8:]) == 0 {
+			return "", false
+		}
+		var (
+			n   = uint64(binary.BigEndian.Uint32(p[20:]))
+			off = uint64(binary.BigEndian.Uint32(p[24:]))
+		)
+		if off+n > uint64(len(p)) {
+			return "", false
+		}
+		u := make([]uint16, n/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(p[off+2*uint64(i):])
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00"), true
+	default:
+		return "", false
+	}
+}
+
+// compareMetadata prints to w the metadata fields of the ref and cand
+// image files that differ, and returns their number.
+func compareMetadata(w io.Writer, ref, cand string) (int, error) {
+	m1, err := readMetadata(ref)
+	if err != nil {
+		return 0, err
+	}
+	m2, err := readMetadata(cand)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]string, 0, len(m1)+len(m2))
+	for k := range m1 {
+		keys = append(keys, k)
+	}
+	for k := range m2 {
+		if _, ok := m1[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	show := func(m map[string]string, k string) string {
+		v, ok := m[k]
+		if !ok {
+			return "<none>"
+		}
+		return fmt.Sprintf("%q", v)
+	}
+
+	n := 0
+	for _, k := range keys {
+		v1, ok1 := m1[k]
+		v2, ok2 := m2[k]
+		if ok1 == ok2 && v1 == v2 {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s != %s\n", k, show(m1, k), show(m2, k))
+		n++
+	}
+	fmt.Fprintf(w, "metadata=%d fields, %d differences\n", len(keys), n)
+	return n, nil
+}
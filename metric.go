@@ -0,0 +1,300 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Names of the supported comparison metrics.
+const (
+	metricYIQ       = "yiq"
+	metricAlpha     = "alpha"
+	metricChebyshev = "chebyshev"
+	metricHausdorff = "hausdorff"
+	metricNCC       = "ncc"
+	metricEMD       = "emd"
+)
+
+// validMetric returns an error if name is not a supported metric.
+func validMetric(name string) error {
+	switch name {
+	case metricYIQ, metricAlpha, metricChebyshev, metricHausdorff, metricNCC, metricEMD:
+		return nil
+	default:
+		return fmt.Errorf("unknown metric %q", name)
+	}
+}
+
+// metricLabel returns the label of the per-pixel differences computed
+// with the named metric.
+func metricLabel(name string) string {
+	switch name {
+	case metricAlpha:
+		return "alpha"
+	case metricChebyshev:
+		return "RGB"
+	default:
+		return "YIQ"
+	}
+}
+
+// pixelMetric returns the per-pixel metric selected by opts, with the
+// weights of the YIQ channels, if any.
+func pixelMetric(opts Options) func(c1, c2 color.RGBA) float64 {
+	switch opts.Metric {
+	case metricAlpha:
+		return alphaDiff
+	case metricChebyshev:
+		return chebyshevDiff
+	}
+	if opts.Weights != nil {
+		return newYIQDiff(opts.Weights)
+	}
+	return yiqDiff
+}
+
+// alphaDiff returns the normalized absolute difference between the alpha
+// channels of 2 pixels.
+func alphaDiff(c1, c2 color.RGBA) float64 {
+	return math.Abs(float64(c1.A)-float64(c2.A)) / 0xff
+}
+
+// chebyshevDiff returns the largest absolute difference between the red,
+// green and blue channels of 2 pixels, normalized to [0, 1].
+func chebyshevDiff(c1, c2 color.RGBA) float64 {
+	var (
+		dr = iabs(int(c1.R) - int(c2.R))
+		dg = iabs(int(c1.G) - int(c2.G))
+		db = iabs(int(c1.B) - int(c2.B))
+	)
+	return float64(imax(dr, imax(dg, db))) / 0xff
+}
+
+// globalMetric applies the global metric named name on the 2 images.
+// It returns false if name is a per-pixel metric.
+func globalMetric(name string, img1, img2 *image.RGBA, opts Options) (float64, bool) {
+	switch name {
+	case metricHausdorff:
+		return hausdorffDist(img1, img2, opts.MaskThreshold), true
+	case metricNCC:
+		return ncc(img1, img2), true
+	case metricEMD:
+		return emd(img1, img2), true
+	default:
+		return 0, false
+	}
+}
+
+// ncc returns the normalized cross-correlation of the luminances of 2
+// images, over the intersection of their bounds: 1 for images identical up
+// to a linear change of brightness, 0 for uncorrelated images and -1 for
+// inverted ones.
+// Uniform images are fully correlated with each other, and uncorrelated
+// with any other image.
+func ncc(img1, img2 *image.RGBA) float64 {
+	bnd := img1.Bounds().Intersect(img2.Bounds())
+	if bnd.Empty() {
+		return 0
+	}
+
+	var (
+		n = float64(bnd.Dx() * bnd.Dy())
+
+		sum1, sum2, sum11, sum22, sum12 float64
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			var (
+				l1 = luminance(img1.RGBAAt(x, y))
+				l2 = luminance(img2.RGBAAt(x, y))
+			)
+			sum1 += l1
+			sum2 += l2
+			sum11 += l1 * l1
+			sum22 += l2 * l2
+			sum12 += l1 * l2
+		}
+	}
+
+	var (
+		cov  = sum12 - sum1*sum2/n
+		v1   = math.Max(sum11-sum1*sum1/n, 0)
+		v2   = math.Max(sum22-sum2*sum2/n, 0)
+		norm = math.Sqrt(v1 * v2)
+	)
+
+	const eps = 1e-12
+	switch {
+	case v1 < eps && v2 < eps:
+		return 1
+	case norm < eps:
+		return 0
+	}
+	return math.Max(-1, math.Min(1, cov/norm))
+}
+
+// luminance returns the normalized luminance, in [0, 1], of a pixel.
+func luminance(c color.RGBA) float64 {
+	return (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) / 255
+}
+
+// hausdorffDist returns the modified Hausdorff distance, in pixels, between
+// the sets of foreground pixels of 2 images, as described in:
+//
+//	A modified Hausdorff distance for object matching.
+//	M.-P. Dubuisson, A. K. Jain.
+//	Proceedings of 12th International Conference on Pattern Recognition, 1994.
+//
+// A pixel belongs to the foreground when its normalized luminance is above
+// the provided threshold.
+func hausdorffDist(img1, img2 *image.RGBA, threshold float64) float64 {
+	var (
+		bnd  = img1.Bounds().Union(img2.Bounds())
+		w, h = bnd.Dx(), bnd.Dy()
+		m1   = foreground(img1, bnd, threshold)
+		m2   = foreground(img2, bnd, threshold)
+	)
+
+	d12, n1 := meanDist(m1, distTransform(m2, w, h))
+	d21, n2 := meanDist(m2, distTransform(m1, w, h))
+	switch {
+	case n1 == 0 && n2 == 0:
+		return 0
+	case n1 == 0 || n2 == 0:
+		return math.Inf(+1)
+	}
+	return math.Max(d12, d21)
+}
+
+// foreground returns the mask of the pixels of img, within bnd, whose
+// normalized luminance is above threshold.
+func foreground(img *image.RGBA, bnd image.Rectangle, threshold float64) []bool {
+	var (
+		w    = bnd.Dx()
+		mask = make([]bool, w*bnd.Dy())
+		src  = img.Bounds()
+	)
+	for y := src.Min.Y; y < src.Max.Y; y++ {
+		for x := src.Min.X; x < src.Max.X; x++ {
+			if luminance(img.RGBAAt(x, y)) > threshold {
+				mask[(y-bnd.Min.Y)*w+x-bnd.Min.X] = true
+			}
+		}
+	}
+	return mask
+}
+
+// meanDist returns the mean distance of the pixels in mask, using the provided
+// squared distance map, as well as the number of pixels in mask.
+func meanDist(mask []bool, dist []float64) (float64, int) {
+	var (
+		sum = 0.0
+		n   = 0
+	)
+	for i, v := range mask {
+		if !v {
+			continue
+		}
+		sum += math.Sqrt(dist[i])
+		n++
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return sum / float64(n), n
+}
+
+// distTransform returns the squared Euclidean distance of each pixel of a
+// w x h grid to the closest pixel set in mask, as described in:
+//
+//	Distance Transforms of Sampled Functions.
+//	P. F. Felzenszwalb, D. P. Huttenlocher.
+//	Theory of Computing, Vol. 8, 2012.
+func distTransform(mask []bool, w, h int) []float64 {
+	const inf = 1e20
+
+	dist := make([]float64, w*h)
+	for i, v := range mask {
+		if !v {
+			dist[i] = inf
+		}
+	}
+
+	n := w
+	if h > n {
+		n = h
+	}
+	var (
+		f = make([]float64, n)
+		d = make([]float64, n)
+		v = make([]int, n)
+		z = make([]float64, n+1)
+	)
+
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			f[y] = dist[y*w+x]
+		}
+		distTransform1D(f[:h], d[:h], v, z)
+		for y := 0; y < h; y++ {
+			dist[y*w+x] = d[y]
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		row := dist[y*w : (y+1)*w]
+		copy(f, row)
+		distTransform1D(f[:w], d[:w], v, z)
+		copy(row, d[:w])
+	}
+
+	return dist
+}
+
+// distTransform1D computes the 1D squared distance transform of f into d,
+// using v and z as scratch space.
+func distTransform1D(f, d []float64, v []int, z []float64) {
+	n := len(f)
+	if n == 0 {
+		return
+	}
+
+	k := 0
+	v[0] = 0
+	z[0] = math.Inf(-1)
+	z[1] = math.Inf(+1)
+	for q := 1; q < n; q++ {
+		s := parabolaX(f, q, v[k])
+		for s <= z[k] {
+			k--
+			s = parabolaX(f, q, v[k])
+		}
+		k++
+		v[k] = q
+		z[k] = s
+		z[k+1] = math.Inf(+1)
+	}
+
+	k = 0
+	for q := 0; q < n; q++ {
+		for z[k+1] < float64(q) {
+			k++
+		}
+		dq := float64(q - v[k])
+		d[q] = dq*dq + f[v[k]]
+	}
+}
+
+// parabolaX returns the abscissa of the intersection of the parabolas
+// rooted at q and p.
+func parabolaX(f []float64, q, p int) float64 {
+	fq := f[q] + float64(q*q)
+	fp := f[p] + float64(p*p)
+	return (fq - fp) / float64(2*q-2*p)
+}
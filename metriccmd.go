@@ -0,0 +1,94 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// metricExternal is the name of the global metric computed by an external
+// command.
+const metricExternal = "external"
+
+// externalMetric runs the command line cmd to compare img1 and img2, and
+// returns the scalar it computed, and its difference image if any.
+//
+// The protocol between img-diff and the command is the following:
+//
+//   - img-diff writes both images to the standard input of the command,
+//     each one as a line holding the size, in bytes, of the image encoded
+//     as PNG, followed by these bytes;
+//   - the command writes to its standard output a line holding the value
+//     of the metric, as a floating-point number, optionally followed by a
+//     difference image, in any format supported by img-diff;
+//   - the command exits with a non-zero status on failure, its standard
+//     error being forwarded to the one of img-diff.
+func externalMetric(ctx context.Context, cmd string, img1, img2 image.Image) (float64, image.Image, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return 0, nil, fmt.Errorf("empty metric command")
+	}
+
+	var stdin bytes.Buffer
+	for _, img := range []image.Image{img1, img2} {
+		var buf bytes.Buffer
+		err := png.Encode(&buf, img)
+		if err != nil {
+			return 0, nil, fmt.Errorf("could not encode image for metric command: %w", err)
+		}
+		fmt.Fprintf(&stdin, "%d\n", buf.Len())
+		_, _ = stdin.Write(buf.Bytes())
+	}
+
+	var stdout bytes.Buffer
+	run := exec.CommandContext(ctx, args[0], args[1:]...)
+	run.Stdin = &stdin
+	run.Stdout = &stdout
+	run.Stderr = os.Stderr
+	err := run.Run()
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not run metric command %q: %w", cmd, err)
+	}
+
+	return readMetricOutput(&stdout)
+}
+
+// readMetricOutput reads the value of a metric and the optional difference
+// image written by an external metric command.
+func readMetricOutput(r io.Reader) (float64, image.Image, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, nil, fmt.Errorf("could not read metric value: %w", err)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not parse metric value: %w", err)
+	}
+
+	raw, err := ioutil.ReadAll(br)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not read metric difference image: %w", err)
+	}
+	if len(raw) == 0 {
+		return v, nil, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decode metric difference image: %w", err)
+	}
+	return v, img, nil
+}
@@ -0,0 +1,28 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+)
+
+// Handling of the pixels of images of different sizes lying outside of
+// the intersection of both images.
+const (
+	mismatchIgnore = "ignore" // pixels outside of the intersection are not compared
+	mismatchFail   = "fail"   // pixels outside of the intersection differ maximally
+	mismatchFill   = "fill"   // missing pixels are compared as the fill color
+)
+
+// validSizeMismatch returns an error if name is not a valid value for
+// Options.SizeMismatch.
+func validSizeMismatch(name string) error {
+	switch name {
+	case mismatchIgnore, mismatchFail, mismatchFill:
+		return nil
+	default:
+		return fmt.Errorf("unknown size mismatch handling %q", name)
+	}
+}
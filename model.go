@@ -0,0 +1,56 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// Common color models into which both images may be converted.
+//
+// Images are always compared as 8-bit premultiplied RGBA, 16-bit inputs
+// being quantized to 8 bits per channel: only the 8-bit color models
+// changing the compared values are available.
+const (
+	modelNone  = "none"
+	modelNRGBA = "nrgba"
+	modelGray  = "gray"
+)
+
+// validModel returns an error if name is not a valid value for
+// Options.CommonModel.
+func validModel(name string) error {
+	switch name {
+	case modelNone, modelNRGBA, modelGray:
+		return nil
+	case "rgba":
+		return fmt.Errorf("unsupported color model %q: images are always compared as 8-bit RGBA", name)
+	case "rgba64", "nrgba64", "gray16":
+		return fmt.Errorf("unsupported color model %q: images are compared with 8 bits per channel", name)
+	default:
+		return fmt.Errorf("unknown color model %q", name)
+	}
+}
+
+// convertModel converts src to the named color model.
+// src is returned as is if name is modelNone or empty.
+func convertModel(src image.Image, name string) image.Image {
+	var (
+		bnds = src.Bounds()
+		dst  draw.Image
+	)
+	switch name {
+	case modelNRGBA:
+		dst = image.NewNRGBA(bnds)
+	case modelGray:
+		dst = image.NewGray(bnds)
+	default:
+		return src
+	}
+	draw.Draw(dst, bnds, src, bnds.Min, draw.Src)
+	return dst
+}
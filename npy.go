@@ -0,0 +1,94 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// floatValues holds unquantized per-pixel differences, row by row.
+type floatValues struct {
+	Rect image.Rectangle
+	Pix  []float32
+}
+
+// newFloatValues returns zero per-pixel differences over r.
+func newFloatValues(r image.Rectangle) *floatValues {
+	return &floatValues{Rect: r, Pix: make([]float32, r.Dx()*r.Dy())}
+}
+
+// set sets the difference of the pixel (x, y) to vd.
+func (v *floatValues) set(x, y int, vd float64) {
+	v.Pix[(y-v.Rect.Min.Y)*v.Rect.Dx()+x-v.Rect.Min.X] = float32(vd)
+}
+
+// writeNPY writes the per-pixel differences values to w, normalized to
+// [0, 1], as a float32 array of shape (H, W) in the NumPy .npy format.
+func writeNPY(w io.Writer, values *floatValues) error {
+	var (
+		bnd = values.Rect
+		hdr = fmt.Sprintf(
+			"{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }",
+			bnd.Dy(), bnd.Dx(),
+		)
+	)
+	// the header is padded with spaces, and terminated by a newline, to
+	// align the data on 64 bytes.
+	const prefix = 10 // magic string, version and header length.
+	if n := (prefix + len(hdr) + 1) % 64; n != 0 {
+		hdr += strings.Repeat(" ", 64-n)
+	}
+	hdr += "\n"
+
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("\x93NUMPY\x01\x00")
+	_ = binary.Write(bw, binary.LittleEndian, uint16(len(hdr)))
+	_, _ = bw.WriteString(hdr)
+
+	var buf [4]byte
+	for _, v := range values.Pix {
+		binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+		_, _ = bw.Write(buf[:])
+	}
+	err := bw.Flush()
+	if err != nil {
+		return fmt.Errorf("could not write NumPy array: %w", err)
+	}
+	return nil
+}
+
+// saveNPY saves the per-pixel differences values to the named .npy file,
+// or to stdout if name is "-".
+func saveNPY(name string, values *floatValues) error {
+	if name == "-" {
+		return writeNPY(os.Stdout, values)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("could not create NumPy file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	err = writeNPY(f, values)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close NumPy file %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+)
+
+// paletteSamples is the maximal number of pixels sampled to extract
+// the dominant colors of an image.
+const paletteSamples = 1 << 16
+
+// swatch is a dominant color of an image.
+type swatch struct {
+	C color.RGBA // opaque color
+	W float64    // fraction of the sampled pixels represented by C
+}
+
+func (s swatch) String() string {
+	return fmt.Sprintf("#%02x%02x%02x:%.1f%%", s.C.R, s.C.G, s.C.B, 100*s.W)
+}
+
+// formatPalette returns the comma-separated list of the swatches of p.
+func formatPalette(p []swatch) string {
+	strs := make([]string, len(p))
+	for i, s := range p {
+		strs[i] = s.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+// dominantColors extracts the (at most) k dominant colors of img, with the
+// median cut algorithm, sorted by decreasing weight.
+// Fully transparent pixels are ignored.
+func dominantColors(img *image.RGBA, k int) []swatch {
+	var (
+		bnd  = img.Bounds()
+		step = int(math.Ceil(math.Sqrt(float64(bnd.Dx()*bnd.Dy()) / paletteSamples)))
+		pix  = make([][3]uint8, 0, paletteSamples)
+	)
+	if step < 1 {
+		step = 1
+	}
+	for y := bnd.Min.Y; y < bnd.Max.Y; y += step {
+		for x := bnd.Min.X; x < bnd.Max.X; x += step {
+			c := img.RGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+			pix = append(pix, [3]uint8{nc.R, nc.G, nc.B})
+		}
+	}
+	if len(pix) == 0 || k <= 0 {
+		return nil
+	}
+
+	boxes := [][][3]uint8{pix}
+	for len(boxes) < k {
+		// split the box with the widest channel range at its median.
+		var (
+			ibox = -1
+			ich  = 0
+			wmax = 0
+		)
+		for i, box := range boxes {
+			ch, w := widestChannel(box)
+			if w > wmax {
+				ibox, ich, wmax = i, ch, w
+			}
+		}
+		if ibox < 0 {
+			break // all boxes hold a single color.
+		}
+
+		box := boxes[ibox]
+		sort.Slice(box, func(i, j int) bool { return box[i][ich] < box[j][ich] })
+		mid := len(box) / 2
+		boxes[ibox] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	p := make([]swatch, len(boxes))
+	for i, box := range boxes {
+		var r, g, b int
+		for _, c := range box {
+			r += int(c[0])
+			g += int(c[1])
+			b += int(c[2])
+		}
+		n := len(box)
+		p[i] = swatch{
+			C: color.RGBA{
+				R: uint8((r + n/2) / n),
+				G: uint8((g + n/2) / n),
+				B: uint8((b + n/2) / n),
+				A: 0xff,
+			},
+			W: float64(n) / float64(len(pix)),
+		}
+	}
+	sort.SliceStable(p, func(i, j int) bool { return p[i].W > p[j].W })
+	return p
+}
+
+// widestChannel returns the channel with the largest range of values in box,
+// and that range.
+func widestChannel(box [][3]uint8) (ch, width int) {
+	if len(box) < 2 {
+		return 0, 0
+	}
+	for i := 0; i < 3; i++ {
+		lo, hi := box[0][i], box[0][i]
+		for _, c := range box[1:] {
+			if c[i] < lo {
+				lo = c[i]
+			}
+			if c[i] > hi {
+				hi = c[i]
+			}
+		}
+		if w := int(hi) - int(lo); w > width {
+			ch, width = i, w
+		}
+	}
+	return ch, width
+}
+
+// paletteDiff returns the difference between 2 palettes: the mean, over
+// both palettes, of the weighted difference between each color and the
+// closest color of the other palette.
+func paletteDiff(p1, p2 []swatch, metric func(c1, c2 color.RGBA) float64) float64 {
+	if len(p1) == 0 || len(p2) == 0 {
+		if len(p1) == len(p2) {
+			return 0
+		}
+		return 1
+	}
+
+	dist := func(p1, p2 []swatch) float64 {
+		sum := 0.0
+		for _, s1 := range p1 {
+			min := math.Inf(+1)
+			for _, s2 := range p2 {
+				min = math.Min(min, metric(s1.C, s2.C))
+			}
+			sum += s1.W * min
+		}
+		return sum
+	}
+	return 0.5 * (dist(p1, p2) + dist(p2, p1))
+}
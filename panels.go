@@ -0,0 +1,90 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+)
+
+// Arrangements of the panels of the GUI and of screenshots.
+const (
+	layoutVertical   = "vertical"   // panels stacked from top to bottom
+	layoutHorizontal = "horizontal" // panels side by side, from left to right
+	layoutGrid       = "grid"       // panels in rows of 2
+)
+
+// validLayout returns an error if name is not a valid value for
+// Options.OutputLayout.
+func validLayout(name string) error {
+	switch name {
+	case layoutVertical, layoutHorizontal, layoutGrid:
+		return nil
+	default:
+		return fmt.Errorf("unknown layout %q", name)
+	}
+}
+
+// layoutColumns returns the number of columns of panels of the named
+// layout, given the number of panels n.
+func layoutColumns(name string, n int) int {
+	switch name {
+	case layoutHorizontal:
+		return n
+	case layoutGrid:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// layoutPanels lays out the panels widgets in rows of cols cells of equal
+// sizes.
+func layoutPanels(gtx C, cols int, widgets []layout.Widget) D {
+	inset := layout.UniformInset(unit.Dp(16))
+	if cols <= 1 {
+		list := layout.List{
+			Axis: layout.Vertical,
+		}
+		return list.Layout(gtx, len(widgets), func(gtx C, i int) D {
+			return inset.Layout(gtx, widgets[i])
+		})
+	}
+
+	var rows []layout.FlexChild
+	for i := 0; i < len(widgets); i += cols {
+		row := widgets[i:imin(i+cols, len(widgets))]
+		rows = append(rows, layout.Flexed(1, func(gtx C) D {
+			cells := make([]layout.FlexChild, cols)
+			for j := range cells {
+				if j >= len(row) {
+					cells[j] = layout.Flexed(1, layout.Spacer{}.Layout)
+					continue
+				}
+				w := row[j]
+				cells[j] = layout.Flexed(1, func(gtx C) D {
+					return inset.Layout(gtx, w)
+				})
+			}
+			return layout.Flex{Axis: layout.Horizontal}.Layout(gtx, cells...)
+		}))
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, rows...)
+}
+
+// panelSize returns the size available to each panel of the named layout,
+// in a window of the provided size, given the number of panels n.
+// The vertical layout devotes a third of the height to each panel.
+func panelSize(name string, size image.Point, n int) image.Point {
+	cols := layoutColumns(name, n)
+	if cols <= 1 {
+		return image.Pt(size.X, size.Y/3)
+	}
+	rows := (n + cols - 1) / cols
+	return image.Pt(size.X/cols, size.Y/rows)
+}
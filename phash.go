@@ -0,0 +1,272 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Sizes of the perceptual hash computation: images are reduced to
+// phashSize x phashSize luminances, whose lowest phashFreqs x phashFreqs
+// DCT frequencies give the bits of the hash.
+const (
+	phashSize  = 32
+	phashFreqs = 8
+)
+
+// runPHash runs the phash sub-command, writing or verifying a manifest of
+// the perceptual hashes of the images of a directory.
+func runPHash(args []string) {
+	fset := flag.NewFlagSet("phash", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: img-diff phash [options] -manifest hashes.txt dir\n\nOptions:\n")
+		fset.PrintDefaults()
+	}
+
+	var (
+		mfest = fset.String("manifest", "", "manifest of the perceptual hashes of the images of dir")
+		write = fset.Bool("write", false, "write the manifest instead of verifying it")
+		dist  = fset.Int("max", 0, "maximum allowed Hamming distance between hashes, in [0, 64]")
+	)
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		fatalf("missing input directory")
+	}
+	if *mfest == "" {
+		fset.Usage()
+		fatalf("missing -manifest")
+	}
+	if *dist < 0 || *dist > 64 {
+		fatalf("invalid -max value %d (must be in [0, 64])", *dist)
+	}
+
+	dir := fset.Arg(0)
+	if *write {
+		err := writePHashes(*mfest, dir)
+		if err != nil {
+			fatalf("could not write manifest: %+v", err)
+		}
+		return
+	}
+
+	ok, err := verifyPHashes(os.Stdout, *mfest, dir, *dist)
+	if err != nil {
+		fatalf("could not verify manifest: %+v", err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// phash returns the 64-bit perceptual hash of img: each bit tells whether
+// a low frequency of the DCT of its luminance is above their median.
+func phash(img image.Image) uint64 {
+	gray := image.NewGray(image.Rect(0, 0, phashSize, phashSize))
+	xdraw.ApproxBiLinear.Scale(gray, gray.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+
+	var (
+		freqs = make([]float64, 0, phashFreqs*phashFreqs)
+		cos   [phashSize][phashFreqs]float64
+	)
+	for x := 0; x < phashSize; x++ {
+		for u := 0; u < phashFreqs; u++ {
+			cos[x][u] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * phashSize))
+		}
+	}
+	for v := 0; v < phashFreqs; v++ {
+		for u := 0; u < phashFreqs; u++ {
+			sum := 0.0
+			for y := 0; y < phashSize; y++ {
+				for x := 0; x < phashSize; x++ {
+					sum += float64(gray.GrayAt(x, y).Y) * cos[x][u] * cos[y][v]
+				}
+			}
+			freqs = append(freqs, sum)
+		}
+	}
+
+	// the DC term only depends on the mean luminance: leave it out of
+	// the median.
+	sorted := append([]float64(nil), freqs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var h uint64
+	for i, f := range freqs {
+		if f > median {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// hamming returns the number of bits differing between the hashes a and b.
+func hamming(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// writePHashes writes to the named manifest the perceptual hashes of the
+// images of dir.
+//
+// Each line of the manifest holds a hash, as 16 hexadecimal digits,
+// followed by the file name of the image, relative to dir.
+func writePHashes(name, dir string) error {
+	files, err := imageFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("could not create manifest file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, rel := range files {
+		img, err := loadImage(filepath.Join(dir, rel))
+		if err != nil {
+			return fmt.Errorf("could not load image %q: %w", rel, err)
+		}
+		fmt.Fprintf(w, "%016x %s\n", phash(img), filepath.ToSlash(rel))
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("could not write manifest file %q: %w", name, err)
+	}
+	return f.Close()
+}
+
+// verifyPHashes recomputes the perceptual hashes of the images of dir, and
+// prints to w the images whose hash is more than max bits away from the
+// one stored in the named manifest, as well as missing and unlisted images.
+// It reports whether all the images matched.
+func verifyPHashes(w io.Writer, name, dir string, max int) (bool, error) {
+	want, err := readPHashes(name)
+	if err != nil {
+		return false, err
+	}
+	files, err := imageFiles(dir)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		nfail = 0
+		found = make(map[string]bool, len(files))
+	)
+	for _, rel := range files {
+		rel = filepath.ToSlash(rel)
+		found[rel] = true
+		h, ok := want[rel]
+		if !ok {
+			fmt.Fprintf(w, "UNLISTED %s\n", rel)
+			nfail++
+			continue
+		}
+		img, err := loadImage(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			fmt.Fprintf(w, "ERROR %s: %+v\n", rel, err)
+			nfail++
+			continue
+		}
+		if d := hamming(h, phash(img)); d > max {
+			fmt.Fprintf(w, "FAIL %s: distance=%d\n", rel, d)
+			nfail++
+		}
+	}
+
+	missing := make([]string, 0, len(want))
+	for rel := range want {
+		if !found[rel] {
+			missing = append(missing, rel)
+		}
+	}
+	sort.Strings(missing)
+	for _, rel := range missing {
+		fmt.Fprintf(w, "MISSING %s\n", rel)
+		nfail++
+	}
+
+	fmt.Fprintf(w, "files=%d, failed=%d\n", len(want), nfail)
+	return nfail == 0, nil
+}
+
+// readPHashes reads the perceptual hashes of the named manifest, indexed
+// by file name. Lines starting with '#' are ignored.
+func readPHashes(name string) (map[string]uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open manifest file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	var (
+		hashes = make(map[string]uint64)
+		sc     = bufio.NewScanner(f)
+		line   = 0
+	)
+	for sc.Scan() {
+		line++
+		txt := strings.TrimSpace(sc.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+		i := strings.IndexAny(txt, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid manifest line %s:%d: expected a hash and a file name", name, line)
+		}
+		h, err := strconv.ParseUint(txt[:i], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash at manifest line %s:%d: %w", name, line, err)
+		}
+		hashes[strings.TrimSpace(txt[i:])] = h
+	}
+	err = sc.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan manifest file %q: %w", name, err)
+	}
+	return hashes, nil
+}
+
+// imageFiles returns the names of the image files of dir and of its
+// sub-directories, relative to dir.
+func imageFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !isImageFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk directory %q: %w", dir, err)
+	}
+	return files, nil
+}
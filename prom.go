@@ -0,0 +1,85 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sample is the outcome of the comparison of a pair of images.
+type sample struct {
+	ref  string // file name of the reference image
+	cand string // file name of the candidate image
+	res  Result
+	err  error // error preventing the comparison, if any
+}
+
+// writeProm prints the statistics of the provided comparisons to w, in the
+// Prometheus text exposition format.
+func writeProm(w io.Writer, samples []sample) {
+	families := []struct {
+		name string
+		help string
+		val  func(res Result) (float64, bool)
+	}{
+		{
+			name: "imgdiff_dmin",
+			help: "Minimal non-zero per-pixel difference.",
+			val:  func(res Result) (float64, bool) { return res.Min, true },
+		},
+		{
+			name: "imgdiff_dmax",
+			help: "Maximal per-pixel difference.",
+			val:  func(res Result) (float64, bool) { return res.Max, true },
+		},
+		{
+			name: "imgdiff_mean",
+			help: "Mean of the per-pixel differences.",
+			val:  func(res Result) (float64, bool) { return res.Mean, true },
+		},
+		{
+			name: "imgdiff_std",
+			help: "Standard deviation of the per-pixel differences.",
+			val:  func(res Result) (float64, bool) { return res.Std, true },
+		},
+		{
+			name: "imgdiff_changed_pixels",
+			help: "Number of differing pixels.",
+			val:  func(res Result) (float64, bool) { return float64(res.Changed), true },
+		},
+		{
+			name: "imgdiff_score",
+			help: "Value of the global comparison metric.",
+			val:  func(res Result) (float64, bool) { return res.Score, res.Metric != "" },
+		},
+	}
+
+	for _, fam := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", fam.name, fam.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", fam.name)
+		for _, s := range samples {
+			v, ok := fam.val(s.res)
+			if !ok {
+				continue
+			}
+			labels := fmt.Sprintf(
+				`reference="%s",candidate="%s"`,
+				promLabel(s.ref), promLabel(s.cand),
+			)
+			if fam.name == "imgdiff_score" {
+				labels += fmt.Sprintf(`,metric="%s"`, promLabel(s.res.Metric))
+			}
+			fmt.Fprintf(w, "%s{%s} %g\n", fam.name, labels, v)
+		}
+	}
+}
+
+// promLabel escapes the backslashes, double quotes and line feeds of a
+// label value.
+func promLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
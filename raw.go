@@ -0,0 +1,76 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// rawGeometry describes the layout of headerless raw image files: 8-bit
+// channels, interleaved, row by row.
+type rawGeometry struct {
+	W, H int // dimensions of the image, in pixels
+	C    int // number of channels: 1 (gray), 3 (RGB) or 4 (RGBA)
+}
+
+// rawGeom is the layout used to load .raw image files.
+// The zero value disables the loading of raw files.
+var rawGeom rawGeometry
+
+// parseRawGeometry parses a raw image layout of the form "WxHxC".
+func parseRawGeometry(s string) (rawGeometry, error) {
+	var g rawGeometry
+	_, err := fmt.Sscanf(s, "%dx%dx%d", &g.W, &g.H, &g.C)
+	if err != nil {
+		return g, fmt.Errorf("could not parse raw geometry %q: %w", s, err)
+	}
+	if g.W <= 0 || g.H <= 0 {
+		return g, fmt.Errorf("invalid raw dimensions %dx%d", g.W, g.H)
+	}
+	switch g.C {
+	case 1, 3, 4:
+	default:
+		return g, fmt.Errorf("invalid number of raw channels %d (want 1, 3 or 4)", g.C)
+	}
+	return g, nil
+}
+
+// decodeRaw decodes a raw image with the layout g.
+// 4-channel images are interpreted as RGBA, premultiplied by alpha.
+func decodeRaw(r io.Reader, g rawGeometry) (image.Image, error) {
+	if g.C == 0 {
+		return nil, fmt.Errorf("missing raw image geometry (see -raw)")
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if n := g.W * g.H * g.C; len(raw) != n {
+		return nil, fmt.Errorf("invalid raw image size %d, want %dx%dx%d=%d bytes", len(raw), g.W, g.H, g.C, n)
+	}
+
+	bnd := image.Rect(0, 0, g.W, g.H)
+	switch g.C {
+	case 1:
+		img := image.NewGray(bnd)
+		copy(img.Pix, raw)
+		return img, nil
+	case 3:
+		img := image.NewRGBA(bnd)
+		for i, j := 0, 0; i < len(raw); i, j = i+3, j+4 {
+			copy(img.Pix[j:j+3], raw[i:i+3])
+			img.Pix[j+3] = 0xff
+		}
+		return img, nil
+	default:
+		img := image.NewRGBA(bnd)
+		copy(img.Pix, raw)
+		return img, nil
+	}
+}
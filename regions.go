@@ -0,0 +1,159 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// maxRegions is the maximal number of regions reported and drawn.
+const maxRegions = 20
+
+// region is a connected region of differing pixels.
+type region struct {
+	Bounds image.Rectangle // bounding box of the region
+	Area   int             // number of pixels of the region
+	Max    float64         // maximal difference within the region
+}
+
+// findRegions returns the 8-connected regions of the pixels of diff whose
+// difference exceeds thr, sorted by decreasing area.
+func findRegions(diff *image.Gray16, thr float64) []region {
+	var (
+		val = func(x, y int) float64 {
+			return float64(diff.Gray16At(x, y).Y) / math.MaxUint16
+		}
+		regs = []region{}
+	)
+	components(diff.Bounds(), func(x, y int) bool { return val(x, y) > thr }, func(pts []image.Point) {
+		reg := region{Bounds: image.Rect(pts[0].X, pts[0].Y, pts[0].X+1, pts[0].Y+1)}
+		for _, p := range pts {
+			reg.Area++
+			reg.Max = math.Max(reg.Max, val(p.X, p.Y))
+			reg.Bounds = reg.Bounds.Union(image.Rect(p.X, p.Y, p.X+1, p.Y+1))
+		}
+		regs = append(regs, reg)
+	})
+
+	sort.SliceStable(regs, func(i, j int) bool { return regs[i].Area > regs[j].Area })
+	return regs
+}
+
+// dropSmallRegions zeroes the differences vals, stored row by row over bnd,
+// of the 8-connected regions of pixels whose difference exceeds thr and
+// whose area is smaller than min.
+// It returns the number of zeroed pixels.
+func dropSmallRegions(vals []float64, bnd image.Rectangle, thr float64, min int) int {
+	var (
+		w     = bnd.Dx()
+		index = func(x, y int) int { return (y-bnd.Min.Y)*w + (x - bnd.Min.X) }
+		n     = 0
+	)
+	components(bnd, func(x, y int) bool { return vals[index(x, y)] > thr }, func(pts []image.Point) {
+		if len(pts) >= min {
+			return
+		}
+		for _, p := range pts {
+			vals[index(p.X, p.Y)] = 0
+		}
+		n += len(pts)
+	})
+	return n
+}
+
+// components calls fn with the pixels of each 8-connected region of the
+// pixels of bnd for which in returns true.
+func components(bnd image.Rectangle, in func(x, y int) bool, fn func(pts []image.Point)) {
+	var (
+		w     = bnd.Dx()
+		seen  = make([]bool, w*bnd.Dy())
+		stack []image.Point
+		pts   []image.Point
+	)
+
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			i := (y-bnd.Min.Y)*w + (x - bnd.Min.X)
+			if seen[i] || !in(x, y) {
+				continue
+			}
+			seen[i] = true
+
+			pts = pts[:0]
+			stack = append(stack[:0], image.Pt(x, y))
+			for len(stack) > 0 {
+				p := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				pts = append(pts, p)
+
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						q := image.Pt(p.X+dx, p.Y+dy)
+						if !q.In(bnd) {
+							continue
+						}
+						j := (q.Y-bnd.Min.Y)*w + (q.X - bnd.Min.X)
+						if seen[j] || !in(q.X, q.Y) {
+							continue
+						}
+						seen[j] = true
+						stack = append(stack, q)
+					}
+				}
+			}
+			fn(pts)
+		}
+	}
+}
+
+// drawRegions returns a copy of img with the bounding boxes of the
+// maxRegions first regions of regs outlined and labeled with their rank and
+// area.
+func drawRegions(img image.Image, regs []region) *image.RGBA {
+	if len(regs) > maxRegions {
+		regs = regs[:maxRegions]
+	}
+	var (
+		bnd = img.Bounds()
+		dst = image.NewRGBA(bnd)
+		col = color.RGBA{R: 0xff, G: 0x40, A: 0xff}
+	)
+	draw.Draw(dst, bnd, img, bnd.Min, draw.Src)
+
+	drw := font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(col),
+		Face: basicfont.Face7x13,
+	}
+	for i, reg := range regs {
+		r := reg.Bounds.Inset(-1).Intersect(bnd)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.SetRGBA(x, r.Min.Y, col)
+			dst.SetRGBA(x, r.Max.Y-1, col)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			dst.SetRGBA(r.Min.X, y, col)
+			dst.SetRGBA(r.Max.X-1, y, col)
+		}
+
+		// label above the box, or inside it if there is no room.
+		y := r.Min.Y - 2
+		if y-basicfont.Face7x13.Ascent < bnd.Min.Y {
+			y = r.Min.Y + basicfont.Face7x13.Ascent + 1
+		}
+		drw.Dot = fixed.P(r.Min.X, y)
+		drw.DrawString(fmt.Sprintf("#%d (%d)", i+1, reg.Area))
+	}
+	return dst
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"gonum.org/v1/plot/palette"
+	"gonum.org/v1/plot/palette/moreland"
+)
+
+// renderDiff returns the visualization of the per-pixel differences stored
+// in diff, given the maximal difference dmax.
+// Iso-difference lines are drawn over img1 if contour levels were requested.
+// Color differences between bilevel images img1 and img2 (e.g. scanned
+// documents) are rendered as a binary overlay, unless a heatmap was
+// requested.
+// If opts.Legend is set, a legend explaining the colors is added below
+// the visualization.
+func renderDiff(diff *image.Gray16, img1, img2 *image.RGBA, dmax float64, opts Options) image.Image {
+	return newDiffRenderer(img1, img2, opts)(diff, dmax)
+}
+
+// newDiffRenderer returns the function rendering the per-pixel differences
+// between img1 and img2 as renderDiff does, choosing the visualization only
+// once, so that strips of differences can be rendered as they are computed.
+func newDiffRenderer(img1, img2 *image.RGBA, opts Options) func(diff *image.Gray16, dmax float64) image.Image {
+	overlaid := len(opts.Contours) == 0 && !opts.Heatmap &&
+		opts.Metric != metricAlpha && bilevel(img1) && bilevel(img2)
+
+	return func(diff *image.Gray16, dmax float64) image.Image {
+		switch {
+		case len(opts.Contours) > 0:
+			img := contourDiff(diff, img1, opts.Contours)
+			if opts.Legend {
+				return withKey(img, contourKeys(opts.Contours))
+			}
+			return img
+
+		case opts.Heatmap:
+			hi := opts.HeatMax
+			if hi < 0 {
+				hi = dmax
+			}
+			img := heatmap(diff, opts.HeatMin, hi, opts.Invert)
+			if opts.Legend {
+				lut := heatLUT(opts.Invert)
+				return withLegend(img, opts.HeatMin, hi, func(t float64) color.Color {
+					return lut[int(math.Round(t*(heatColors-1)))]
+				})
+			}
+			return img
+
+		case overlaid:
+			img := overlay(img1, img2, diff.Bounds(), opts.Invert)
+			if opts.Legend {
+				return withKey(img, []legendKey{
+					{overlayRemoved, "removed"},
+					{overlayAdded, "added"},
+					{overlayKept, "kept"},
+				})
+			}
+			return img
+
+		case opts.Invert:
+			// leave the per-pixel differences untouched.
+			bnd := diff.Bounds()
+			inv := image.NewGray16(bnd)
+			for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+				for x := bnd.Min.X; x < bnd.Max.X; x++ {
+					inv.SetGray16(x, y, color.Gray16{Y: math.MaxUint16 - diff.Gray16At(x, y).Y})
+				}
+			}
+			diff = inv
+		}
+		if opts.Legend {
+			return withLegend(diff, 0, 1, func(t float64) color.Color {
+				if opts.Invert {
+					t = 1 - t
+				}
+				return color.Gray16{Y: uint16(t * math.MaxUint16)}
+			})
+		}
+		return diff
+	}
+}
+
+// thresholdDiff returns a binary rendering of the per-pixel differences
+// stored in diff: differences above thr are painted in red, the other ones
+// in black (white if invert is true).
+func thresholdDiff(diff *image.Gray16, thr float64, invert bool) *image.RGBA {
+	var (
+		bnd = diff.Bounds()
+		dst = image.NewRGBA(bnd)
+		lim = uint16(math.Min(thr, 1) * math.MaxUint16)
+		hi  = color.RGBA{R: 0xff, A: 0xff}
+		lo  = color.RGBA{A: 0xff}
+	)
+	if invert {
+		lo = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	}
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := lo
+			if diff.Gray16At(x, y).Y > lim {
+				c = hi
+			}
+			dst.SetRGBA(x, y, c)
+		}
+	}
+	return dst
+}
+
+// heatmap returns a color rendering of the per-pixel differences stored in
+// diff, mapping the [lo, hi] range onto a black-body color map (reversed if
+// invert is true).
+// Differences outside of that range are clamped to the end colors.
+func heatmap(diff *image.Gray16, lo, hi float64, invert bool) *image.RGBA {
+	var (
+		lut = heatLUT(invert)
+		bnd = diff.Bounds()
+		dst = image.NewRGBA(bnd)
+	)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			var (
+				v = float64(diff.Gray16At(x, y).Y) / math.MaxUint16
+				t float64
+			)
+			switch {
+			case hi > lo:
+				t = (v - lo) / (hi - lo)
+			case v > lo:
+				t = 1
+			}
+			t = math.Max(0, math.Min(1, t))
+			dst.SetRGBA(x, y, lut[int(math.Round(t*(heatColors-1)))])
+		}
+	}
+	return dst
+}
+
+// heatColors is the number of colors of the heatmap.
+const heatColors = 256
+
+// heatLUT returns the colors of the heatmap, from the smallest to the
+// largest differences.
+func heatLUT(invert bool) [heatColors]color.RGBA {
+	var cmap palette.ColorMap = moreland.BlackBody()
+	if invert {
+		cmap = palette.Reverse(cmap)
+	}
+	cmap.SetMin(0)
+	cmap.SetMax(1)
+
+	var lut [heatColors]color.RGBA
+	for i, c := range cmap.Palette(len(lut)).Colors() {
+		lut[i] = color.RGBAModel.Convert(c).(color.RGBA)
+	}
+	return lut
+}
+
+// Colors of the binary overlay.
+var (
+	overlayBackground = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	overlayKept       = color.RGBA{R: 0xc0, G: 0xc0, B: 0xc0, A: 0xff}
+	overlayRemoved    = color.RGBA{R: 0xe0, A: 0xff}
+	overlayAdded      = color.RGBA{G: 0xa0, B: 0xff, A: 0xff}
+)
+
+// bilevelTolerance is the largest distance to black or white of the
+// pixels of bilevel images.
+const bilevelTolerance = 0x10
+
+// bilevel reports whether all the pixels of img, composed over a white
+// background, are black or white, within bilevelTolerance.
+// Continuous-tone grayscale images are not bilevel.
+func bilevel(img *image.RGBA) bool {
+	bnd := img.Bounds()
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c.R != c.G || c.G != c.B {
+				return false
+			}
+			v := int(c.R) + 0xff - int(c.A)
+			if v > bilevelTolerance && v < 0xff-bilevelTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// overlay returns a binary rendering of the differences between the
+// bilevel images img1 and img2 over bnd, where dark pixels are ink:
+// ink removed from img1 is drawn in red, ink added to img2 in blue and
+// ink present in both images in light gray.
+// The background is white, or black if invert is true.
+func overlay(img1, img2 *image.RGBA, bnd image.Rectangle, invert bool) *image.RGBA {
+	bkg := overlayBackground
+	if invert {
+		bkg = color.RGBA{A: 0xff}
+	}
+
+	ink := func(img *image.RGBA, x, y int) bool {
+		if !image.Pt(x, y).In(img.Bounds()) {
+			return false
+		}
+		c := img.RGBAAt(x, y)
+		// compare the luminance of the pixel composed over a white background.
+		return int(c.R)+0xff-int(c.A) < 0x80
+	}
+
+	dst := image.NewRGBA(bnd)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			var (
+				i1 = ink(img1, x, y)
+				i2 = ink(img2, x, y)
+			)
+			switch {
+			case i1 && i2:
+				dst.SetRGBA(x, y, overlayKept)
+			case i1:
+				dst.SetRGBA(x, y, overlayRemoved)
+			case i2:
+				dst.SetRGBA(x, y, overlayAdded)
+			default:
+				dst.SetRGBA(x, y, bkg)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	revealSteps = 10  // number of frames painting differing pixels
+	revealDelay = 30  // delay, in 100ths of a second, between frames
+	revealHold  = 200 // delay, in 100ths of a second, of the last frame
+)
+
+var revealColor = color.RGBA{R: 0xff, A: 0xff}
+
+// revealFrames returns the frames of an animation revealing the differing
+// pixels of values over a faded img, largest differences first.
+// The first frame shows no differences, and each following frame paints an
+// equal share of the remaining differing pixels.
+func revealFrames(img image.Image, values *image.Gray16) []*image.Paletted {
+	var (
+		bnd  = values.Bounds()
+		rect = image.Rect(0, 0, bnd.Dx(), bnd.Dy())
+		base = image.NewPaletted(rect, palette.Plan9)
+		pts  []image.Point
+	)
+	// fade the image to light gray, so that differences stand out.
+	draw.Draw(base, rect, image.White, image.Point{}, draw.Src)
+	for y := bnd.Min.Y; y < bnd.Max.Y; y++ {
+		for x := bnd.Min.X; x < bnd.Max.X; x++ {
+			if image.Pt(x, y).In(img.Bounds()) {
+				g := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+				g.Y = 0xff - (0xff-g.Y)/4
+				base.Set(x-bnd.Min.X, y-bnd.Min.Y, g)
+			}
+			if values.Gray16At(x, y).Y > 0 {
+				pts = append(pts, image.Pt(x, y))
+			}
+		}
+	}
+	sort.SliceStable(pts, func(i, j int) bool {
+		return values.Gray16At(pts[i].X, pts[i].Y).Y > values.Gray16At(pts[j].X, pts[j].Y).Y
+	})
+
+	frames := []*image.Paletted{base}
+	cur := base
+	for i := 1; i <= revealSteps; i++ {
+		var (
+			beg = (i - 1) * len(pts) / revealSteps
+			end = i * len(pts) / revealSteps
+		)
+		if beg == end {
+			continue
+		}
+		next := image.NewPaletted(rect, cur.Palette)
+		copy(next.Pix, cur.Pix)
+		for _, p := range pts[beg:end] {
+			next.Set(p.X-bnd.Min.X, p.Y-bnd.Min.Y, revealColor)
+		}
+		frames = append(frames, next)
+		cur = next
+	}
+	return frames
+}
+
+// writeReveal writes to w a looping GIF animation revealing the differing
+// pixels of values over img, largest differences first.
+func writeReveal(w io.Writer, img image.Image, values *image.Gray16) error {
+	var (
+		frames = revealFrames(img, values)
+		delays = make([]int, len(frames))
+	)
+	for i := range delays {
+		delays[i] = revealDelay
+	}
+	delays[len(delays)-1] = revealHold
+
+	err := gif.EncodeAll(w, &gif.GIF{
+		Image: frames,
+		Delay: delays,
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode GIF animation: %w", err)
+	}
+	return nil
+}
+
+// saveReveal saves the animation revealing the differing pixels of values
+// over img to the named file, or to stdout if name is "-".
+func saveReveal(name string, img image.Image, values *image.Gray16) error {
+	if values == nil {
+		return fmt.Errorf("no per-pixel differences to reveal")
+	}
+	if name == "-" {
+		return writeReveal(os.Stdout, img, values)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("could not create animation file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	err = writeReveal(f, img, values)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close animation file %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// Directions of the line splitting a side-by-side image in 2 halves.
+const (
+	splitNone       = ""
+	splitVertical   = "vertical"   // left and right halves
+	splitHorizontal = "horizontal" // top and bottom halves
+)
+
+// validSplit returns an error if name is not a valid split direction.
+func validSplit(name string) error {
+	switch name {
+	case splitNone, splitVertical, splitHorizontal:
+		return nil
+	default:
+		return fmt.Errorf("unknown split direction %q", name)
+	}
+}
+
+// splitImage splits img in 2 halves of the same size, along the direction
+// dir, and returns them with their bounds starting at the origin.
+// The middle column (or row) of images of odd width (or height) is dropped.
+func splitImage(img image.Image, dir string) (first, second image.Image) {
+	var (
+		bnd  = img.Bounds()
+		size = image.Pt(bnd.Dx()/2, bnd.Dy())
+		off  = image.Pt(bnd.Dx()-size.X, 0)
+	)
+	if dir == splitHorizontal {
+		size = image.Pt(bnd.Dx(), bnd.Dy()/2)
+		off = image.Pt(0, bnd.Dy()-size.Y)
+	}
+
+	half := func(min image.Point) image.Image {
+		dst := image.NewRGBA(image.Rectangle{Max: size})
+		draw.Draw(dst, dst.Bounds(), img, min, draw.Src)
+		return dst
+	}
+	return half(bnd.Min), half(bnd.Min.Add(off))
+}
+
+// splitNames returns the names of the halves of the named image split
+// along the direction dir.
+func splitNames(name, dir string) (first, second string) {
+	if dir == splitHorizontal {
+		return name + ":top", name + ":bottom"
+	}
+	return name + ":left", name + ":right"
+}
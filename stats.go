@@ -0,0 +1,239 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"go-hep.org/x/hep/hbook"
+)
+
+// diffStats compares the pixels of 2 images and accumulates their
+// differences into the statistics of a Result.
+// It is shared by in-memory and streamed comparisons, which feed it pixel
+// by pixel.
+type diffStats struct {
+	opts   Options
+	metric func(c1, c2 color.RGBA) float64
+	athr   float64               // alpha threshold, in [0, 0xff]
+	inner  image.Rectangle       // compared area, without the ignored border
+	conv   bool                  // whether differences are converted to opts.Units
+	units  func(float64) float64 // conversion of the differences to opts.Units
+
+	hist *hbook.H1D    // distribution of the differences (nil in stats-only mode)
+	diff *image.Gray16 // per-pixel differences (nil in stats-only mode)
+	vals *floatValues  // unquantized per-pixel differences, if saved with -npy
+	grid *tileGrid     // mean differences of the tiles of the grid, if requested
+
+	// with a minimal area, differences are recorded first, and only added
+	// once the regions smaller than this area are dropped.
+	area    image.Rectangle // compared area
+	pending []float64       // recorded differences over area (NaN if not compared), if opts.MinArea is set
+
+	min, max     float64
+	n, sum, sum2 float64
+	nchg         int             // number of differing pixels
+	nign         int             // number of ignored pixels
+	chg          image.Rectangle // bounding box of the differing pixels
+	zmax         []float64       // maximal differences within the zones
+	rest         float64         // maximal difference outside of the zones
+
+	blank [2]uniformity // uniformity of the reference and candidate images
+}
+
+// newDiffStats returns the statistics of the comparison, with opts, of 2
+// images over area.
+// The difference image covers full, the union of the bounds of both images.
+func newDiffStats(full, area image.Rectangle, opts Options) *diffStats {
+	st := &diffStats{
+		opts:   opts,
+		metric: pixelMetric(opts),
+		athr:   opts.AlphaThreshold * 0xff,
+		inner:  opts.IgnoreBorder.inner(area),
+		conv:   opts.Units == unitsJND || opts.Units == unitsLevels,
+		units:  toUnits(opts),
+		min:    +math.MaxFloat64,
+		max:    -math.MaxFloat64,
+		zmax:   make([]float64, len(opts.Zones)),
+		area:   area,
+	}
+	if !opts.StatsOnly {
+		st.hist = hbook.NewH1D(100, 0, 1)
+		st.diff = image.NewGray16(full)
+		if opts.NPYOut != "" {
+			st.vals = newFloatValues(full)
+		}
+	}
+	if opts.Grid != (image.Point{}) {
+		st.grid = newTileGrid(area, opts.Grid)
+	}
+	if opts.MinArea > 0 {
+		st.pending = make([]float64, area.Dx()*area.Dy())
+		for i := range st.pending {
+			st.pending[i] = math.NaN() // not compared.
+		}
+	}
+	return st
+}
+
+// ignored returns whether the pixel (x, y) lies in the ignored border,
+// counting it as ignored if so.
+func (st *diffStats) ignored(x, y int) bool {
+	if image.Pt(x, y).In(st.inner) {
+		return false
+	}
+	st.nign++
+	return true
+}
+
+// compare returns the difference between the colors c1 and c2 of the pixel
+// (x, y) of both images, or false if that pixel is ignored, for lying in
+// the ignored border or matching the ignored color.
+func (st *diffStats) compare(x, y int, c1, c2 color.RGBA) (float64, bool) {
+	if st.ignored(x, y) {
+		// leave the pixel neutral in the difference image.
+		return 0, false
+	}
+	if ign := st.opts.IgnoreColor; ign != nil &&
+		(ignored(c1, *ign, st.opts.IgnoreTolerance) ||
+			ignored(c2, *ign, st.opts.IgnoreTolerance)) {
+		// leave the pixel neutral in the difference image.
+		st.nign++
+		return 0, false
+	}
+	if float64(c1.A) < st.athr && float64(c2.A) < st.athr {
+		return 0, true
+	}
+	return st.metric(c1, c2), true
+}
+
+// record accumulates the difference vd of the pixel (x, y), or keeps it
+// for flush if small regions of differences are dropped.
+func (st *diffStats) record(x, y int, vd float64) {
+	if st.pending == nil {
+		st.add(x, y, vd)
+		return
+	}
+	st.pending[(y-st.area.Min.Y)*st.area.Dx()+x-st.area.Min.X] = vd
+}
+
+// flush drops the regions of differences smaller than opts.MinArea and
+// accumulates the remaining recorded differences.
+// It returns the number of dropped pixels.
+func (st *diffStats) flush() int {
+	if st.pending == nil {
+		return 0
+	}
+	var (
+		area   = st.area
+		nsmall = dropSmallRegions(st.pending, area, math.Max(histThreshold(st.opts), 0), st.opts.MinArea)
+	)
+	debugf("dropped %d pixels of regions smaller than %d pixels", nsmall, st.opts.MinArea)
+	for x := area.Min.X; x < area.Max.X; x++ {
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			if vd := st.pending[(y-area.Min.Y)*area.Dx()+x-area.Min.X]; !math.IsNaN(vd) {
+				st.add(x, y, vd)
+			}
+		}
+	}
+	return nsmall
+}
+
+// add accumulates the difference vd of the pixel (x, y).
+func (st *diffStats) add(x, y int, vd float64) {
+	opts := st.opts
+	if st.hist != nil && (vd > 0 || !opts.HistSkipZero) {
+		st.hist.Fill(vd, 1)
+	}
+	if vd > 0 {
+		st.min = math.Min(vd, st.min)
+		st.nchg++
+		st.chg = st.chg.Union(image.Rect(x, y, x+1, y+1))
+	}
+	st.max = math.Max(vd, st.max)
+	if len(st.zmax) > 0 {
+		if i := zoneOf(opts.Zones, image.Pt(x, y)); i >= 0 {
+			st.zmax[i] = math.Max(vd, st.zmax[i])
+		} else {
+			st.rest = math.Max(vd, st.rest)
+		}
+	}
+	if vd > 0 || !opts.SkipZero {
+		u := vd
+		if st.conv {
+			u = st.units(vd)
+		}
+		st.n++
+		st.sum += u
+		st.sum2 += u * u
+		if st.grid != nil {
+			st.grid.fill(x, y, u)
+		}
+	}
+	if st.diff != nil {
+		st.diff.SetGray16(x, y, color.Gray16{Y: uint16(vd * math.MaxUint16)})
+	}
+	if st.vals != nil {
+		st.vals.set(x, y, vd)
+	}
+}
+
+// dmax returns the maximal difference, before its conversion to units.
+func (st *diffStats) dmax() float64 {
+	if st.max == -math.MaxFloat64 {
+		return 0
+	}
+	return st.max
+}
+
+// result fills res with the accumulated statistics: the extrema, mean and
+// standard deviation of the differences, the differing pixels, the grid,
+// the zones and the warnings about uniform images.
+func (st *diffStats) result(res *Result) {
+	opts := st.opts
+	res.Hist = st.hist
+	res.Exact = st.vals
+	res.Min = st.min
+	if res.Min == math.MaxFloat64 {
+		res.Min = 0
+	}
+	res.Max = st.dmax()
+	res.Units = opts.Units
+	res.Changed = st.nchg
+	res.Changes = st.chg
+	res.Ignored = st.nign
+
+	for i := range st.blank {
+		if c, ok := st.blank[i].uniform(); ok {
+			res.Warnings = append(res.Warnings, blankWarning(i, c))
+		}
+	}
+	if st.grid != nil {
+		res.Grid = st.grid.means()
+	}
+	if len(st.zmax) > 0 {
+		res.Rest = st.rest
+		if st.conv {
+			res.Rest = st.units(st.rest)
+		}
+		res.Zones = make([]zoneResult, len(st.zmax))
+		for i, v := range st.zmax {
+			if st.conv {
+				v = st.units(v)
+			}
+			res.Zones[i] = zoneResult{zone: opts.Zones[i], DMax: v}
+		}
+	}
+	if st.conv {
+		res.Min = st.units(res.Min)
+		res.Max = st.units(res.Max)
+	}
+	if st.n > 0 {
+		res.Mean = st.sum / st.n
+		res.Std = math.Sqrt(math.Max(st.sum2/st.n-res.Mean*res.Mean, 0))
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PNG color types.
+const (
+	pngGray      = 0
+	pngRGB       = 2
+	pngPaletted  = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// pngRows decodes the rows of a non-interlaced PNG image one at a time,
+// keeping only the current and previous rows in memory.
+//
+// Pixels are converted to RGBA exactly as image/png and image/draw
+// would, so that streamed comparisons match in-memory ones.
+type pngRows struct {
+	f *os.File
+	z io.ReadCloser // decompressed IDAT data
+
+	w, h  int
+	depth int   // bits per sample (8 or 16)
+	ctype uint8 // color type
+	bpp   int   // bytes per pixel
+
+	pal  color.Palette
+	trns []byte // contents of the tRNS chunk, if any
+
+	cur, prev []byte // current and previous rows, filter byte excluded
+}
+
+// openPNGRows opens the named PNG file for row by row decoding.
+// It returns false if the image can not be streamed: interlaced images and
+// bit depths below 8 are only handled by image/png.
+func openPNGRows(name string) (*pngRows, bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not open image file %q: %w", name, err)
+	}
+	p, ok, err := newPNGRows(f)
+	if err != nil || !ok {
+		_ = f.Close()
+		if err != nil {
+			err = fmt.Errorf("could not decode PNG image file %q: %w", name, err)
+		}
+		return nil, false, err
+	}
+	return p, true, nil
+}
+
+func newPNGRows(f *os.File) (*pngRows, bool, error) {
+	r := bufio.NewReader(f)
+	var sig [8]byte
+	_, err := io.ReadFull(r, sig[:])
+	if err != nil {
+		return nil, false, err
+	}
+	if string(sig[:]) != "\x89PNG\r\n\x1a\n" {
+		return nil, false, fmt.Errorf("invalid PNG signature")
+	}
+
+	p := &pngRows{f: f}
+	for {
+		var hdr [8]byte
+		_, err := io.ReadFull(r, hdr[:])
+		if err != nil {
+			return nil, false, err
+		}
+		var (
+			n   = binary.BigEndian.Uint32(hdr[:4])
+			typ = string(hdr[4:])
+		)
+		if typ == "IDAT" {
+			if p.w == 0 {
+				return nil, false, fmt.Errorf("missing IHDR chunk")
+			}
+			z, err := zlib.NewReader(&idatReader{r: r, left: n})
+			if err != nil {
+				return nil, false, err
+			}
+			p.z = z
+			p.cur = make([]byte, p.w*p.bpp)
+			p.prev = make([]byte, p.w*p.bpp)
+			return p, true, nil
+		}
+
+		data := make([]byte, n+4) // chunk data and CRC.
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, false, err
+		}
+		data = data[:n]
+
+		switch typ {
+		case "IHDR":
+			if n != 13 {
+				return nil, false, fmt.Errorf("invalid IHDR chunk")
+			}
+			p.w = int(binary.BigEndian.Uint32(data[0:]))
+			p.h = int(binary.BigEndian.Uint32(data[4:]))
+			p.depth = int(data[8])
+			p.ctype = data[9]
+			if interlaced := data[12] != 0; interlaced || (p.depth != 8 && p.depth != 16) {
+				return nil, false, nil
+			}
+			var spp int // samples per pixel
+			switch p.ctype {
+			case pngGray:
+				spp = 1
+			case pngRGB:
+				spp = 3
+			case pngPaletted:
+				spp = 1
+				if p.depth != 8 {
+					return nil, false, fmt.Errorf("invalid bit depth %d of paletted image", p.depth)
+				}
+			case pngGrayAlpha:
+				spp = 2
+			case pngRGBA:
+				spp = 4
+			default:
+				return nil, false, fmt.Errorf("invalid color type %d", p.ctype)
+			}
+			p.bpp = spp * p.depth / 8
+		case "PLTE":
+			p.pal = make(color.Palette, n/3)
+			for i := range p.pal {
+				p.pal[i] = color.RGBA{data[3*i], data[3*i+1], data[3*i+2], 0xff}
+			}
+		case "tRNS":
+			p.trns = data
+			if p.ctype == pngPaletted {
+				for i, a := range data {
+					if i >= len(p.pal) {
+						break
+					}
+					c := p.pal[i].(color.RGBA)
+					p.pal[i] = color.NRGBA{c.R, c.G, c.B, a}
+				}
+			}
+		case "iCCP":
+			if !ignoreICC {
+				// images with an ICC profile are converted to sRGB in memory.
+				return nil, false, nil
+			}
+		case "IEND":
+			return nil, false, fmt.Errorf("missing IDAT chunk")
+		}
+	}
+}
+
+// Close closes the underlying file.
+func (p *pngRows) Close() error {
+	_ = p.z.Close()
+	return p.f.Close()
+}
+
+// next decodes the next row of the image into row.
+func (p *pngRows) next(row []color.RGBA) error {
+	var filter [1]byte
+	_, err := io.ReadFull(p.z, filter[:])
+	if err != nil {
+		return fmt.Errorf("could not read PNG row: %w", err)
+	}
+	p.prev, p.cur = p.cur, p.prev
+	_, err = io.ReadFull(p.z, p.cur)
+	if err != nil {
+		return fmt.Errorf("could not read PNG row: %w", err)
+	}
+	err = unfilter(filter[0], p.cur, p.prev, p.bpp)
+	if err != nil {
+		return err
+	}
+
+	var (
+		cur = p.cur
+		s16 = func(i int) uint16 { return binary.BigEndian.Uint16(cur[i:]) }
+	)
+	for x := range row {
+		var (
+			c color.Color
+			i = x * p.bpp
+		)
+		switch p.ctype {
+		case pngGray:
+			switch p.depth {
+			case 8:
+				c = color.Gray{cur[i]}
+				if len(p.trns) >= 2 {
+					a := uint8(0xff)
+					if cur[i] == p.trns[1] {
+						a = 0
+					}
+					c = color.NRGBA{cur[i], cur[i], cur[i], a}
+				}
+			default:
+				c = color.Gray16{s16(i)}
+				if len(p.trns) >= 2 {
+					v, a := s16(i), uint16(0xffff)
+					if v == binary.BigEndian.Uint16(p.trns) {
+						a = 0
+					}
+					c = color.NRGBA64{v, v, v, a}
+				}
+			}
+		case pngRGB:
+			switch p.depth {
+			case 8:
+				c = color.RGBA{cur[i], cur[i+1], cur[i+2], 0xff}
+				if len(p.trns) >= 6 {
+					a := uint8(0xff)
+					if cur[i] == p.trns[1] && cur[i+1] == p.trns[3] && cur[i+2] == p.trns[5] {
+						a = 0
+					}
+					c = color.NRGBA{cur[i], cur[i+1], cur[i+2], a}
+				}
+			default:
+				c = color.RGBA64{s16(i), s16(i + 2), s16(i + 4), 0xffff}
+				if len(p.trns) >= 6 {
+					a := uint16(0xffff)
+					if s16(i) == binary.BigEndian.Uint16(p.trns) &&
+						s16(i+2) == binary.BigEndian.Uint16(p.trns[2:]) &&
+						s16(i+4) == binary.BigEndian.Uint16(p.trns[4:]) {
+						a = 0
+					}
+					c = color.NRGBA64{s16(i), s16(i + 2), s16(i + 4), a}
+				}
+			}
+		case pngPaletted:
+			if int(cur[i]) >= len(p.pal) {
+				return fmt.Errorf("palette index %d out of range", cur[i])
+			}
+			c = p.pal[cur[i]]
+		case pngGrayAlpha:
+			switch p.depth {
+			case 8:
+				c = color.NRGBA{cur[i], cur[i], cur[i], cur[i+1]}
+			default:
+				c = color.NRGBA64{s16(i), s16(i), s16(i), s16(i + 2)}
+			}
+		case pngRGBA:
+			switch p.depth {
+			case 8:
+				c = color.NRGBA{cur[i], cur[i+1], cur[i+2], cur[i+3]}
+			default:
+				c = color.NRGBA64{s16(i), s16(i + 2), s16(i + 4), s16(i + 6)}
+			}
+		}
+		row[x] = color.RGBAModel.Convert(c).(color.RGBA)
+	}
+	return nil
+}
+
+// unfilter reverses the PNG filter of the row cur, given the previous row
+// prev and the number of bytes per pixel bpp.
+func unfilter(filter byte, cur, prev []byte, bpp int) error {
+	switch filter {
+	case 0: // none
+	case 1: // sub
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2: // up
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case 3: // average
+		for i := range cur {
+			var left int
+			if i >= bpp {
+				left = int(cur[i-bpp])
+			}
+			cur[i] += uint8((left + int(prev[i])) / 2)
+		}
+	case 4: // Paeth
+		for i := range cur {
+			var a, c int
+			if i >= bpp {
+				a, c = int(cur[i-bpp]), int(prev[i-bpp])
+			}
+			cur[i] += uint8(paeth(a, int(prev[i]), c))
+		}
+	default:
+		return fmt.Errorf("invalid PNG filter type %d", filter)
+	}
+	return nil
+}
+
+// paeth returns the Paeth predictor of the left (a), above (b) and upper
+// left (c) bytes.
+func paeth(a, b, c int) int {
+	var (
+		p  = a + b - c
+		pa = iabs(p - a)
+		pb = iabs(p - b)
+		pc = iabs(p - c)
+	)
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+// idatReader reads the data of consecutive IDAT chunks.
+type idatReader struct {
+	r    *bufio.Reader
+	left uint32 // bytes left in the current chunk
+}
+
+func (r *idatReader) Read(p []byte) (int, error) {
+	for r.left == 0 {
+		// skip the CRC of the current chunk, and read the header of the
+		// next one.
+		var hdr [12]byte
+		_, err := io.ReadFull(r.r, hdr[:])
+		if err != nil {
+			return 0, err
+		}
+		if string(hdr[8:]) != "IDAT" {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.left = binary.BigEndian.Uint32(hdr[4:8])
+	}
+	if uint32(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= uint32(n)
+	return n, err
+}
+
+// canStream reports whether the ref and cand images can be compared row by
+// row, by streamDiff: both must be local non-interlaced PNG files of the
+// same size, compared in stats-only mode with a per-pixel metric and no
+// option needing the whole images (alignment, smoothing, antialiasing
+// detection, ...).
+func canStream(ref, cand string, opts Options) bool {
+	switch {
+	case !opts.StatsOnly,
+		opts.Metric != metricYIQ && opts.Metric != metricAlpha && opts.Metric != metricChebyshev,
+		opts.MetricCmd != "",
+		opts.CommonModel != modelNone,
+		opts.Premultiplied != premulNone,
+		opts.Channels != "" && opts.Channels != channelsAll,
+		opts.Align > 0, opts.DPR != 1, opts.Equalize, opts.Blur > 0,
+		opts.AntiAliasing, opts.MinArea > 0, opts.Palette > 0, opts.BitDepth, opts.Classify,
+		opts.CVD != "" && opts.CVD != cvdNone,
+		opts.Sample > 0 && opts.Sample < 1:
+		return false
+	}
+
+	var dims [2]image.Point
+	for i, name := range []string{ref, cand} {
+		if isURL(name) || !strings.EqualFold(filepath.Ext(name), ".png") {
+			return false
+		}
+		p, ok, err := openPNGRows(name)
+		if err != nil || !ok {
+			return false
+		}
+		dims[i] = image.Pt(p.w, p.h)
+		_ = p.Close()
+	}
+	return dims[0] == dims[1]
+}
+
+// streamDiff compares the ref and cand PNG images, which must satisfy
+// canStream, decoding them one row at a time.
+func streamDiff(ref, cand string, opts Options) (Result, error) {
+	defer timed("streamDiff", time.Now())
+
+	p1, _, err := openPNGRows(ref)
+	if err != nil {
+		return Result{}, err
+	}
+	defer p1.Close()
+	p2, _, err := openPNGRows(cand)
+	if err != nil {
+		return Result{}, err
+	}
+	defer p2.Close()
+
+	var (
+		bnd  = image.Rect(0, 0, p1.w, p1.h)
+		st   = newDiffStats(bnd, bnd, opts)
+		row1 = make([]color.RGBA, p1.w)
+		row2 = make([]color.RGBA, p2.w)
+	)
+	for y := 0; y < p1.h; y++ {
+		err := p1.next(row1)
+		if err != nil {
+			return Result{}, fmt.Errorf("could not decode %q: %w", ref, err)
+		}
+		err = p2.next(row2)
+		if err != nil {
+			return Result{}, fmt.Errorf("could not decode %q: %w", cand, err)
+		}
+		for x, c1 := range row1 {
+			c2 := row2[x]
+			st.blank[0].add(c1)
+			st.blank[1].add(c2)
+			if vd, ok := st.compare(x, y, c1, c2); ok {
+				st.add(x, y, vd)
+			}
+		}
+	}
+
+	var res Result
+	st.result(&res)
+	res.Compared = bnd.Dx()*bnd.Dy() - st.nign
+	return res, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStreamDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "img-diff-")
+	if err != nil {
+		t.Fatalf("could not create tmp dir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		img1 = newTestImage(40, 30, image.Rect(10, 10, 20, 20), color.NRGBA{R: 0xff, A: 0xff})
+		img2 = newTestImage(40, 30, image.Rect(12, 10, 22, 20), color.NRGBA{R: 0xe0, A: 0xff})
+		ref  = filepath.Join(dir, "ref.png")
+		cand = filepath.Join(dir, "cand.png")
+	)
+	img2.SetNRGBA(35, 5, color.NRGBA{B: 0xff, A: 0xff})
+	writeTestPNG(t, ref, img1)
+	writeTestPNG(t, cand, img2)
+
+	white := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"default", Options{}},
+		{"stats-only", Options{StatsOnly: true}},
+		{"stats-skip-zero", Options{SkipZero: true}},
+		{"units=levels", Options{Units: unitsLevels}},
+		{"units=jnd", Options{Units: unitsJND}},
+		{"grid", Options{Grid: image.Pt(4, 3)}},
+		{"ignore-border", Options{IgnoreBorder: border{Top: 2, Right: 6, Bottom: 1, Left: 11}}},
+		{"ignore-color", Options{IgnoreColor: &white}},
+		{"max-per-region", Options{Zones: []zone{{Name: "box", Rect: image.Rect(0, 0, 16, 16), Max: 0.5}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.Metric = metricYIQ
+
+			want, err := imageDiffContext(context.Background(), img1, img2, opts)
+			if err != nil {
+				t.Fatalf("could not compare images: %+v", err)
+			}
+			got, err := streamDiff(ref, cand, opts)
+			if err != nil {
+				t.Fatalf("could not stream images: %+v", err)
+			}
+
+			for _, v := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"min", got.Min, want.Min},
+				{"max", got.Max, want.Max},
+				{"mean", got.Mean, want.Mean},
+				{"std", got.Std, want.Std},
+				{"rest", got.Rest, want.Rest},
+			} {
+				if !closeTo(v.got, v.want) {
+					t.Errorf("invalid %s: got=%g, want=%g", v.name, v.got, v.want)
+				}
+			}
+			for _, v := range []struct {
+				name      string
+				got, want interface{}
+			}{
+				{"compared", got.Compared, want.Compared},
+				{"changed", got.Changed, want.Changed},
+				{"changes", got.Changes, want.Changes},
+				{"ignored", got.Ignored, want.Ignored},
+				{"zones", got.Zones, want.Zones},
+				{"warnings", got.Warnings, want.Warnings},
+			} {
+				if !reflect.DeepEqual(v.got, v.want) {
+					t.Errorf("invalid %s:\ngot= %v\nwant=%v", v.name, v.got, v.want)
+				}
+			}
+			if len(got.Grid) != len(want.Grid) {
+				t.Fatalf("invalid grid rows: got=%d, want=%d", len(got.Grid), len(want.Grid))
+			}
+			for j := range want.Grid {
+				for i := range want.Grid[j] {
+					if g, w := got.Grid[j][i], want.Grid[j][i]; !closeTo(g, w) {
+						t.Errorf("invalid grid tile (%d, %d): got=%g, want=%g", i, j, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+// newTestImage returns a white w×h image with the rectangle box filled
+// with c.
+func newTestImage(w, h int, box image.Rectangle, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+			if image.Pt(x, y).In(box) {
+				img.SetNRGBA(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+func writeTestPNG(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("could not create %q: %+v", name, err)
+	}
+	defer f.Close()
+	err = png.Encode(f, img)
+	if err != nil {
+		t.Fatalf("could not encode %q: %+v", name, err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("could not close %q: %+v", name, err)
+	}
+}
+
+// closeTo reports whether a and b are equal, up to the rounding errors of
+// accumulations performed in different orders.
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-12*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
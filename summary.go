@@ -0,0 +1,125 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// jsonRecord is the outcome of the comparison of a pair of images, as
+// appended to a JSON summary file.
+type jsonRecord struct {
+	Time   time.Time `json:"time"`
+	Ref    string    `json:"ref"`
+	Cand   string    `json:"cand"`
+	Status string    `json:"status"`          // PASS, WARN, FAIL or ERROR
+	Error  string    `json:"error,omitempty"` // error preventing the comparison, if any
+
+	Similarity float64  `json:"similarity"`
+	Compared   int      `json:"compared"`
+	Changed    int      `json:"changed"`
+	Min        float64  `json:"min"`
+	Max        float64  `json:"max"`
+	Mean       float64  `json:"mean"`
+	Std        float64  `json:"std"`
+	Units      string   `json:"units,omitempty"`
+	Blur       float64  `json:"blur,omitempty"` // standard deviation of the Gaussian smoothing of both images, if any
+	Metric     string   `json:"metric,omitempty"`
+	Score      float64  `json:"score,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"` // uniform images, and mismatches between animated images
+}
+
+// newJSONRecord returns the record of the comparison res of the ref and
+// cand images, with status st.
+func newJSONRecord(ref, cand string, res Result, st status) jsonRecord {
+	return jsonRecord{
+		Time:       time.Now().UTC(),
+		Ref:        ref,
+		Cand:       cand,
+		Status:     st.String(),
+		Similarity: res.Similarity(),
+		Compared:   res.Compared,
+		Changed:    res.Changed,
+		Min:        res.Min,
+		Max:        res.Max,
+		Mean:       res.Mean,
+		Std:        res.Std,
+		Units:      res.Units,
+		Blur:       res.Blur,
+		Metric:     res.Metric,
+		Score:      res.Score,
+		Warnings:   res.Warnings,
+	}
+}
+
+// newJSONError returns the record of a comparison of the ref and cand
+// images prevented by err.
+func newJSONError(ref, cand string, err error) jsonRecord {
+	return jsonRecord{
+		Time:   time.Now().UTC(),
+		Ref:    ref,
+		Cand:   cand,
+		Status: "ERROR",
+		Error:  err.Error(),
+	}
+}
+
+// appendJSON appends recs to the JSON array stored in the named file,
+// creating it if it does not exist.
+// The file is replaced atomically, so that it always holds a valid array.
+func appendJSON(name string, recs []jsonRecord) error {
+	var all []json.RawMessage
+	raw, err := ioutil.ReadFile(name)
+	switch {
+	case os.IsNotExist(err):
+		// first run.
+	case err != nil:
+		return fmt.Errorf("could not read JSON summary %q: %w", name, err)
+	default:
+		err = json.Unmarshal(raw, &all)
+		if err != nil {
+			return fmt.Errorf("could not decode JSON summary %q: %w", name, err)
+		}
+	}
+	for _, rec := range recs {
+		v, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("could not encode JSON record: %w", err)
+		}
+		all = append(all, v)
+	}
+	out, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode JSON summary: %w", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create JSON summary %q: %w", name, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// temporary files are only readable by their owner.
+	_ = f.Chmod(0644)
+	_, err = f.Write(append(out, '\n'))
+	if err != nil {
+		return fmt.Errorf("could not write JSON summary %q: %w", name, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close JSON summary %q: %w", name, err)
+	}
+	err = os.Rename(f.Name(), name)
+	if err != nil {
+		return fmt.Errorf("could not replace JSON summary %q: %w", name, err)
+	}
+	return nil
+}
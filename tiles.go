@@ -0,0 +1,41 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// stripWidth is the width, in pixels, of the strips of differences
+// published by imageDiffContext while it computes them.
+const stripWidth = 64
+
+// diffStrip is a rendered strip of the differences of an in-flight
+// comparison.
+type diffStrip struct {
+	full image.Rectangle // bounds of the whole difference image
+	img  image.Image     // rendering of the strip
+}
+
+// paintStrip draws the rendered strip of differences s onto dst, the
+// downsampled preview of the whole difference image.
+func paintStrip(dst *image.RGBA, s diffStrip) {
+	var (
+		src = s.img.Bounds()
+		bnd = s.full
+		sx  = float64(dst.Bounds().Dx()) / float64(bnd.Dx())
+		sy  = float64(dst.Bounds().Dy()) / float64(bnd.Dy())
+		dr  = image.Rect(
+			int(math.Round(float64(src.Min.X-bnd.Min.X)*sx)),
+			int(math.Round(float64(src.Min.Y-bnd.Min.Y)*sy)),
+			int(math.Round(float64(src.Max.X-bnd.Min.X)*sx)),
+			int(math.Round(float64(src.Max.Y-bnd.Min.Y)*sy)),
+		)
+	)
+	xdraw.ApproxBiLinear.Scale(dst, dr, s.img, src, xdraw.Src, nil)
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// Units of the per-pixel differences of the YIQ metric.
+const (
+	unitsYIQ    = "yiq"    // normalized YIQ difference, in [0, 1]
+	unitsJND    = "jnd"    // just-noticeable differences
+	unitsLevels = "levels" // 8-bit gray levels
+)
+
+// jndDeltaE is the CIELAB color difference of a just-noticeable difference,
+// as given in:
+//
+//	Digital Color Imaging Handbook.
+//	G. Sharma, CRC Press, 2003.
+const jndDeltaE = 2.3
+
+// validUnits returns an error if name is not a valid value for
+// Options.Units.
+func validUnits(name string) error {
+	switch name {
+	case unitsYIQ, unitsJND, unitsLevels:
+		return nil
+	default:
+		return fmt.Errorf("unknown units %q", name)
+	}
+}
+
+// toJND converts a normalized YIQ difference to just-noticeable differences.
+//
+// The YIQ metric is a normalized squared distance: its square root is the
+// YIQ distance relative to the one between black and white, which spans
+// 100 units of CIELAB lightness. The relative distance is thus scaled to
+// 100 before being divided by the CIELAB difference of a just-noticeable
+// difference. This is an approximation, most accurate for luminance
+// differences.
+func toJND(v float64) float64 {
+	return 100 * math.Sqrt(v) / jndDeltaE
+}
+
+// fromJND converts just-noticeable differences to a normalized YIQ
+// difference. It is the inverse of toJND.
+func fromJND(jnd float64) float64 {
+	d := jnd * jndDeltaE / 100
+	return d * d
+}
+
+// yiqLevel returns the normalized YIQ difference, with the weights of the
+// Y, I and Q channels of opts, between 2 grays differing by one 8-bit
+// level: the I and Q deltas are then zero, and the difference grows with
+// the square of the number of levels.
+func yiqLevel(opts Options) float64 {
+	metric := yiqDiff
+	if opts.Weights != nil {
+		metric = newYIQDiff(opts.Weights)
+	}
+	return metric(color.RGBA{A: 0xff}, color.RGBA{R: 1, G: 1, B: 1, A: 0xff})
+}
+
+// levelPrecision is the precision of differences in 8-bit gray levels,
+// absorbing the rounding errors of the YIQ conversion: grays differing by
+// N levels are then exactly N levels apart.
+const levelPrecision = 1e-6
+
+// toLevels converts a normalized YIQ difference to 8-bit gray levels: the
+// difference between 2 grays differing by that many levels, given the
+// difference level of a single level (see yiqLevel).
+func toLevels(v, level float64) float64 {
+	return math.Round(math.Sqrt(v/level)/levelPrecision) * levelPrecision
+}
+
+// fromLevels converts 8-bit gray levels to a normalized YIQ difference. It
+// is the inverse of toLevels.
+func fromLevels(n, level float64) float64 {
+	return n * n * level
+}
+
+// identity returns v.
+func identity(v float64) float64 { return v }
+
+// toUnits returns the function converting a normalized YIQ difference to
+// the units of opts.
+func toUnits(opts Options) func(v float64) float64 {
+	switch opts.Units {
+	case unitsJND:
+		return toJND
+	case unitsLevels:
+		level := yiqLevel(opts)
+		return func(v float64) float64 { return toLevels(v, level) }
+	default:
+		return identity
+	}
+}
+
+// fromUnits returns the function converting a difference in the units of
+// opts to a normalized YIQ difference. It is the inverse of toUnits.
+func fromUnits(opts Options) func(v float64) float64 {
+	switch opts.Units {
+	case unitsJND:
+		return fromJND
+	case unitsLevels:
+		level := yiqLevel(opts)
+		return func(n float64) float64 { return fromLevels(n, level) }
+	default:
+		return identity
+	}
+}
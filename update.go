@@ -0,0 +1,74 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Baselines updated from their candidates in manifest and directory modes.
+const (
+	updateNone   = "none"
+	updateFailed = "failed"
+	updateAll    = "all"
+)
+
+// validUpdate returns an error if name is not a valid value for
+// Options.Update.
+func validUpdate(name string) error {
+	switch name {
+	case updateNone, updateFailed, updateAll:
+		return nil
+	default:
+		return fmt.Errorf("unknown baseline update mode %q", name)
+	}
+}
+
+// needsUpdate reports whether a baseline whose comparison has status st
+// should be updated, given the update mode.
+func needsUpdate(mode string, st status) bool {
+	switch mode {
+	case updateAll:
+		return true
+	case updateFailed:
+		return st == statusFail
+	default:
+		return false
+	}
+}
+
+// updateBaseline replaces the reference image file ref with the candidate
+// image cand, decoded as img.
+// The candidate file is copied as is if both files have the same format,
+// and img is encoded in the format of ref otherwise.
+func updateBaseline(ref, cand string, img image.Image, opts Options) error {
+	switch {
+	case isURL(ref):
+		return fmt.Errorf("can not update remote baseline %q", ref)
+	case isURL(cand), strings.HasPrefix(cand, "color:"),
+		!strings.EqualFold(filepath.Ext(ref), filepath.Ext(cand)):
+		return saveImage(ref, img, opts)
+	}
+
+	raw, err := ioutil.ReadFile(cand)
+	if err != nil {
+		return fmt.Errorf("could not read candidate %q: %w", cand, err)
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(ref); err == nil {
+		mode = fi.Mode()
+	}
+	err = ioutil.WriteFile(ref, raw, mode)
+	if err != nil {
+		return fmt.Errorf("could not write baseline %q: %w", ref, err)
+	}
+	return nil
+}
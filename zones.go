@@ -0,0 +1,126 @@
+// Copyright 2021 The img-diff Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// zone is a rectangle of the images with its own maximum allowed
+// difference.
+type zone struct {
+	Name string          // name of the zone, if any
+	Rect image.Rectangle // pixels of the zone
+	Max  float64         // maximum allowed difference within the zone
+}
+
+// zoneResult is the outcome of the comparison of the pixels of a zone.
+type zoneResult struct {
+	zone
+	DMax float64 // maximal difference within the zone
+}
+
+// readZones reads the zones listed in the named file.
+//
+// Each non-empty line holds the x0, y0, x1 and y1 coordinates of the
+// rectangle of a zone and its maximum allowed difference, optionally
+// followed by its name. Lines starting with '#' are ignored.
+func readZones(name string) ([]zone, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open zones file %q: %w", name, err)
+	}
+	defer f.Close()
+
+	var (
+		zones []zone
+		sc    = bufio.NewScanner(f)
+		line  = 0
+	)
+	for sc.Scan() {
+		line++
+		txt := strings.TrimSpace(sc.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+		toks := strings.Fields(txt)
+		if len(toks) < 5 {
+			return nil, fmt.Errorf("invalid zones line %s:%d: expected at least 5 fields, got %d", name, line, len(toks))
+		}
+		var vs [4]int
+		for i := range vs {
+			vs[i], err = strconv.Atoi(toks[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid coordinate at zones line %s:%d: %w", name, line, err)
+			}
+		}
+		z := zone{
+			Name: strings.Join(toks[5:], " "),
+			Rect: image.Rect(vs[0], vs[1], vs[2], vs[3]),
+		}
+		z.Max, err = strconv.ParseFloat(toks[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold at zones line %s:%d: %w", name, line, err)
+		}
+		if z.Rect.Empty() {
+			return nil, fmt.Errorf("empty zone at zones line %s:%d", name, line)
+		}
+		zones = append(zones, z)
+	}
+
+	err = sc.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan zones file %q: %w", name, err)
+	}
+	return zones, nil
+}
+
+// zoneOf returns the index of the first of zones holding the pixel p, or
+// -1 if there is none.
+func zoneOf(zones []zone, p image.Point) int {
+	for i, z := range zones {
+		if p.In(z.Rect) {
+			return i
+		}
+	}
+	return -1
+}
+
+// zonesFailed reports whether any zone of res exceeds its maximum allowed
+// difference.
+func zonesFailed(res Result) bool {
+	for _, z := range res.Zones {
+		if z.DMax > z.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// writeZones prints the maximal differences of the zones of res to w.
+func writeZones(w io.Writer, res Result) {
+	fmt.Fprintf(w, "zones=%d, rest=%g\n", len(res.Zones), res.Rest)
+	for i, z := range res.Zones {
+		st := "ok"
+		if z.DMax > z.Max {
+			st = "FAIL"
+		}
+		name := ""
+		if z.Name != "" {
+			name = fmt.Sprintf(" %q", z.Name)
+		}
+		fmt.Fprintf(w,
+			"zone #%d%s: bounds=(%d, %d)-(%d, %d), max=%g, limit=%g, %s\n",
+			i+1, name, z.Rect.Min.X, z.Rect.Min.Y, z.Rect.Max.X, z.Rect.Max.Y,
+			z.DMax, z.Max, st,
+		)
+	}
+}